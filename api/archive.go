@@ -0,0 +1,155 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/sero-cash/mine-pool/util"
+)
+
+const maxArchiveDays = 365
+
+func (s *ApiServer) ArchiveBlocksIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	page := pageParam(r)
+	blocks, total, err := s.archive.GetBlocks(page*s.config.Blocks, s.config.Blocks)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch blocks from archive: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	reply["matured"] = blocks
+	reply["maturedTotal"] = total
+	reply["page"] = page
+	reply["pageSize"] = s.config.Blocks
+
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+func (s *ApiServer) ArchivePaymentsIndex(w http.ResponseWriter, r *http.Request) {
+	s.writeArchivePayments(w, r, "")
+}
+
+func (s *ApiServer) ArchiveAccountPaymentsIndex(w http.ResponseWriter, r *http.Request) {
+	login := mux.Vars(r)["login"]
+	if !util.IsValidBase58Address(login) {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Invalid adress %s", login)
+		return
+	}
+	s.writeArchivePayments(w, r, login)
+}
+
+func (s *ApiServer) writeArchivePayments(w http.ResponseWriter, r *http.Request, login string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	page := pageParam(r)
+	payments, total, err := s.archive.GetPayments(login, page*s.config.Payments, s.config.Payments)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch payments from archive: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	reply["payments"] = payments
+	reply["paymentsTotal"] = total
+	reply["page"] = page
+	reply["pageSize"] = s.config.Payments
+
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+func (s *ApiServer) ArchiveAccountCreditsIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	login := mux.Vars(r)["login"]
+	if !util.IsValidBase58Address(login) {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Invalid adress %s", login)
+		return
+	}
+	page := pageParam(r)
+	credits, total, err := s.archive.GetCredits(login, page*s.config.Blocks, s.config.Blocks)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch credits from archive: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	reply["credits"] = credits
+	reply["creditsTotal"] = total
+	reply["page"] = page
+	reply["pageSize"] = s.config.Blocks
+
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+// Daily average hashrate of the pool or of a single account if login is given.
+func (s *ApiServer) ArchiveHashrateIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	login := mux.Vars(r)["login"]
+	if len(login) > 0 && !util.IsValidBase58Address(login) {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Invalid adress %s", login)
+		return
+	}
+	days, err := strconv.ParseInt(r.URL.Query().Get("days"), 10, 64)
+	if err != nil || days <= 0 || days > maxArchiveDays {
+		days = 30
+	}
+	series, err := s.archive.GetDailyHashrate(login, days)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch hashrate from archive: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	reply["hashrate"] = series
+	reply["days"] = days
+
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+// Zero based page number from query string, invalid values fall back to the first page.
+func pageParam(r *http.Request) int64 {
+	page, err := strconv.ParseInt(r.URL.Query().Get("page"), 10, 64)
+	if err != nil || page < 0 {
+		return 0
+	}
+	return page
+}
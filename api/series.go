@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/sero-cash/mine-pool/storage"
+	"github.com/sero-cash/mine-pool/util"
+)
+
+// Samples every completed short interval, waits a bit past the boundary for late shares.
+func (s *ApiServer) sampleSeries() {
+	log.Printf("Set hashrate series sampling every %v", s.series.ShortInterval)
+	for {
+		bucket := storage.SeriesBucket(s.series.ShortInterval)
+		next := time.Unix(bucket, 0).Add(s.series.ShortInterval).Add(5 * time.Second)
+		time.Sleep(time.Until(next))
+
+		bucket = storage.SeriesBucket(s.series.ShortInterval)
+		start := time.Now()
+		ok, err := s.backend.WriteSeriesSample(bucket, s.series)
+		if err != nil {
+			log.Printf("Failed to write hashrate series sample: %v", err)
+		} else if ok {
+			log.Printf("Hashrate series sampled at %v, elapsed time %v", bucket, time.Since(start))
+		}
+	}
+}
+
+// Pool, account or worker series depending on route, "resolution" is "short" (default) or "long".
+func (s *ApiServer) SeriesIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	vars := mux.Vars(r)
+	var scope []string
+	if login, ok := vars["login"]; ok {
+		if !util.IsValidBase58Address(login) {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Printf("Invalid adress %s", login)
+			return
+		}
+		scope = append(scope, login)
+		if worker, ok := vars["worker"]; ok {
+			scope = append(scope, worker)
+		}
+	}
+
+	resolution := storage.SeriesShort
+	retention := s.series.ShortRetention
+	if r.URL.Query().Get("resolution") == storage.SeriesLong {
+		resolution = storage.SeriesLong
+		retention = s.series.LongRetention
+	}
+	from := util.MakeTimestamp()/1000 - int64(retention/time.Second)
+	series, err := s.backend.GetSeries(resolution, from, scope...)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch series from backend: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	reply["now"] = util.MakeTimestamp()
+	reply["resolution"] = resolution
+	reply["series"] = series
+
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
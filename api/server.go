@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"sort"
@@ -28,17 +29,37 @@ type ApiConfig struct {
 	PurgeOnly            bool   `json:"purgeOnly"`
 	PurgeInterval        string `json:"purgeInterval"`
 	Sign                 string `json:"sign"`
+	Series               Series `json:"series"`
+
+	// Flags logins finding suspiciously few blocks
+	Withholding Withholding `json:"withholding"`
+}
+
+type Series struct {
+	Enabled        bool   `json:"enabled"`
+	ShortInterval  string `json:"shortInterval"`
+	ShortRetention string `json:"shortRetention"`
+	LongInterval   string `json:"longInterval"`
+	LongRetention  string `json:"longRetention"`
 }
 
 type ApiServer struct {
-	config              *ApiConfig
-	backend             *storage.RedisClient
-	hashrateWindow      time.Duration
-	hashrateLargeWindow time.Duration
-	stats               atomic.Value
-	miners              map[string]*Entry
-	minersMu            sync.RWMutex
-	statsIntv           time.Duration
+	config    *ApiConfig
+	backend   *storage.RedisClient
+	archive   *storage.PostgresClient
+	windows   atomic.Value
+	stats     atomic.Value
+	miners    map[string]*Entry
+	minersMu  sync.RWMutex
+	statsIntv time.Duration
+	series    *storage.SeriesConfig
+}
+
+// Stats windows, replaced on config reload
+type windows struct {
+	hashrate      time.Duration
+	hashrateLarge time.Duration
+	luck          []int
 }
 
 type Entry struct {
@@ -46,16 +67,63 @@ type Entry struct {
 	updatedAt int64
 }
 
-func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
+// Archive is optional, historical endpoints are served only when it's set.
+func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient, archive *storage.PostgresClient) *ApiServer {
 	hashrateWindow := util.MustParseDuration(cfg.HashrateWindow)
 	hashrateLargeWindow := util.MustParseDuration(cfg.HashrateLargeWindow)
-	return &ApiServer{
-		config:              cfg,
-		backend:             backend,
-		hashrateWindow:      hashrateWindow,
-		hashrateLargeWindow: hashrateLargeWindow,
-		miners:              make(map[string]*Entry),
+	var series *storage.SeriesConfig
+	if cfg.Series.Enabled {
+		series = &storage.SeriesConfig{
+			ShortInterval:  util.MustParseDuration(cfg.Series.ShortInterval),
+			ShortRetention: util.MustParseDuration(cfg.Series.ShortRetention),
+			LongInterval:   util.MustParseDuration(cfg.Series.LongInterval),
+			LongRetention:  util.MustParseDuration(cfg.Series.LongRetention),
+		}
+		if series.LongInterval%series.ShortInterval != 0 {
+			log.Fatalf("Series long interval %v must be a multiple of short interval %v", series.LongInterval, series.ShortInterval)
+		}
+		if series.ShortInterval > hashrateWindow {
+			log.Fatalf("Series short interval %v can't exceed hashrate window %v", series.ShortInterval, hashrateWindow)
+		}
+	}
+	s := &ApiServer{
+		config:  cfg,
+		backend: backend,
+		archive: archive,
+		miners:  make(map[string]*Entry),
+		series:  series,
+	}
+	s.windows.Store(newWindows(hashrateWindow, hashrateLargeWindow, cfg.LuckWindow))
+	return s
+}
+
+func newWindows(hashrate, hashrateLarge time.Duration, luck []int) *windows {
+	w := &windows{hashrate: hashrate, hashrateLarge: hashrateLarge}
+	w.luck = append([]int(nil), luck...)
+	sort.Ints(w.luck)
+	return w
+}
+
+func (s *ApiServer) currentWindows() *windows {
+	return s.windows.Load().(*windows)
+}
+
+// Applies new hashrate and luck windows, the rest of settings is kept until restart.
+func (s *ApiServer) Reload(cfg *ApiConfig) error {
+	hashrateWindow, err := time.ParseDuration(cfg.HashrateWindow)
+	if err != nil {
+		return fmt.Errorf("invalid hashrate window: %v", err)
+	}
+	hashrateLargeWindow, err := time.ParseDuration(cfg.HashrateLargeWindow)
+	if err != nil {
+		return fmt.Errorf("invalid large hashrate window: %v", err)
+	}
+	if s.series != nil && s.series.ShortInterval > hashrateWindow {
+		return fmt.Errorf("series short interval %v can't exceed hashrate window %v", s.series.ShortInterval, hashrateWindow)
 	}
+	s.windows.Store(newWindows(hashrateWindow, hashrateLargeWindow, cfg.LuckWindow))
+	log.Printf("Reloaded API windows, hashrate %v / %v, luck %v", hashrateWindow, hashrateLargeWindow, cfg.LuckWindow)
+	return nil
 }
 
 func (s *ApiServer) Start() {
@@ -73,8 +141,6 @@ func (s *ApiServer) Start() {
 	purgeTimer := time.NewTimer(purgeIntv)
 	log.Printf("Set purge interval to %v", purgeIntv)
 
-	sort.Ints(s.config.LuckWindow)
-
 	if s.config.PurgeOnly {
 		s.purgeStale()
 	} else {
@@ -82,6 +148,10 @@ func (s *ApiServer) Start() {
 		s.collectStats()
 	}
 
+	if s.series != nil {
+		go s.sampleSeries()
+	}
+
 	go func() {
 		for {
 			select {
@@ -109,7 +179,23 @@ func (s *ApiServer) listen() {
 	r.HandleFunc("/api/blocks", s.BlocksIndex)
 	r.HandleFunc("/api/payments", s.PaymentsIndex)
 	r.HandleFunc("/api/accounts/{login}", s.AccountIndex)
+	if s.series != nil {
+		r.HandleFunc("/api/series", s.SeriesIndex)
+		r.HandleFunc("/api/accounts/{login}/series", s.SeriesIndex)
+		r.HandleFunc("/api/accounts/{login}/workers/{worker}/series", s.SeriesIndex)
+	}
 	r.HandleFunc("/api/payments/download/{begin}/{end}", s.DowloadPayments)
+	if s.config.Withholding.Enabled {
+		r.HandleFunc("/api/withholding", s.WithholdingIndex)
+	}
+	if s.archive != nil {
+		r.HandleFunc("/api/archive/blocks", s.ArchiveBlocksIndex)
+		r.HandleFunc("/api/archive/payments", s.ArchivePaymentsIndex)
+		r.HandleFunc("/api/archive/hashrate", s.ArchiveHashrateIndex)
+		r.HandleFunc("/api/archive/accounts/{login}/payments", s.ArchiveAccountPaymentsIndex)
+		r.HandleFunc("/api/archive/accounts/{login}/credits", s.ArchiveAccountCreditsIndex)
+		r.HandleFunc("/api/archive/accounts/{login}/hashrate", s.ArchiveHashrateIndex)
+	}
 	r.NotFoundHandler = http.HandlerFunc(notFound)
 	err := http.ListenAndServe(s.config.Listen, r)
 	if err != nil {
@@ -126,7 +212,8 @@ func notFound(w http.ResponseWriter, r *http.Request) {
 
 func (s *ApiServer) purgeStale() {
 	start := time.Now()
-	total, err := s.backend.FlushStaleStats(s.hashrateWindow, s.hashrateLargeWindow)
+	windows := s.currentWindows()
+	total, err := s.backend.FlushStaleStats(windows.hashrate, windows.hashrateLarge)
 	if err != nil {
 		log.Println("Failed to purge stale data from backend:", err)
 	} else {
@@ -136,18 +223,28 @@ func (s *ApiServer) purgeStale() {
 
 func (s *ApiServer) collectStats() {
 	start := time.Now()
-	stats, err := s.backend.CollectStats(s.hashrateWindow, s.config.Blocks, s.config.Payments)
+	windows := s.currentWindows()
+	stats, err := s.backend.CollectStats(windows.hashrate, s.config.Blocks, s.config.Payments)
 	if err != nil {
 		log.Printf("Failed to fetch stats from backend: %v", err)
 		return
 	}
-	if len(s.config.LuckWindow) > 0 {
-		stats["luck"], err = s.backend.CollectLuckStats(s.config.LuckWindow)
+	if len(windows.luck) > 0 {
+		stats["luck"], err = s.backend.CollectLuckStats(windows.luck)
 		if err != nil {
 			log.Printf("Failed to fetch luck stats from backend: %v", err)
 			return
 		}
 	}
+	// Report is optional, snapshot is stored without it
+	if s.config.Withholding.Enabled {
+		withholding, err := s.collectWithholding()
+		if err != nil {
+			log.Printf("Failed to fetch block expectations from backend: %v", err)
+		} else {
+			stats["withholding"] = withholding
+		}
+	}
 	s.stats.Store(stats)
 	log.Printf("Stats collection finished %s", time.Since(start))
 }
@@ -174,6 +271,7 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 		reply["maturedTotal"] = stats["maturedTotal"]
 		reply["immatureTotal"] = stats["immatureTotal"]
 		reply["candidatesTotal"] = stats["candidatesTotal"]
+		reply["failedTotal"] = stats["failedTotal"]
 	}
 
 	err = json.NewEncoder(w).Encode(reply)
@@ -218,6 +316,8 @@ func (s *ApiServer) BlocksIndex(w http.ResponseWriter, r *http.Request) {
 		reply["immatureTotal"] = stats["immatureTotal"]
 		reply["candidates"] = stats["candidates"]
 		reply["candidatesTotal"] = stats["candidatesTotal"]
+		reply["failed"] = stats["failed"]
+		reply["failedTotal"] = stats["failedTotal"]
 		reply["luck"] = stats["luck"]
 	}
 
@@ -283,7 +383,8 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Failed to fetch stats from backend: %v", err)
 			return
 		}
-		workers, err := s.backend.CollectWorkersStats(s.hashrateWindow, s.hashrateLargeWindow, login)
+		windows := s.currentWindows()
+		workers, err := s.backend.CollectWorkersStats(windows.hashrate, windows.hashrateLarge, login)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Printf("Failed to fetch stats from backend: %v", err)
@@ -338,7 +439,18 @@ func (s *ApiServer) DowloadPayments(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
 	beginUnixStr := strconv.FormatInt(util.GetBeginOfDay(begin), 10)
 	endUnixStr := strconv.FormatInt(util.GetEndOfDay(end), 10)
-	paymets := s.backend.GetPayments(beginUnixStr, endUnixStr)
+	var paymets []map[string]interface{}
+	if s.archive != nil {
+		var err error
+		paymets, err = s.archive.GetPaymentsBetween(util.GetBeginOfDay(begin), util.GetEndOfDay(end))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Failed to fetch payments from archive: %v", err)
+			return
+		}
+	} else {
+		paymets = s.backend.GetPayments(beginUnixStr, endUnixStr)
+	}
 	util.WritePayments(paymets, w)
 	w.WriteHeader(http.StatusOK)
 
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/sero-cash/mine-pool/storage"
+	"github.com/sero-cash/mine-pool/util"
+)
+
+// Report only, payouts of flagged logins are held by payer
+type Withholding struct {
+	Enabled bool `json:"enabled"`
+	// Login is flagged when chance of honest miner finding this few blocks falls below it
+	Threshold float64 `json:"threshold"`
+	// Logins expected to find fewer blocks are not judged
+	MinExpected float64 `json:"minExpected"`
+}
+
+type WithholdingEntry struct {
+	Login       string  `json:"login"`
+	Expected    float64 `json:"expected"`
+	Found       int64   `json:"found"`
+	Probability float64 `json:"probability"`
+	Flagged     bool    `json:"flagged"`
+	Held        bool    `json:"held"`
+}
+
+// Compares blocks found by each login against its accumulated share difficulty, least likely first.
+func (s *ApiServer) collectWithholding() ([]*WithholdingEntry, error) {
+	cfg := s.config.Withholding
+	expectations, err := s.backend.GetBlockExpectations(cfg.MinExpected)
+	if err != nil {
+		return nil, err
+	}
+	holds, err := s.backend.GetPayoutHolds()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*WithholdingEntry, 0, len(expectations))
+	for _, e := range expectations {
+		entry := &WithholdingEntry{Login: e.Login, Expected: e.Expected, Found: e.Found}
+		entry.Probability = util.PoissonCDF(e.Found, e.Expected)
+		entry.Flagged = entry.Probability < cfg.Threshold
+		// Released holds are kept, so operator decision is not overridden
+		reason, hasHold := holds[e.Login]
+		entry.Held = hasHold && reason != storage.PayoutReleased
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Probability < entries[j].Probability })
+	return entries, nil
+}
+
+func (s *ApiServer) WithholdingIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	stats := s.getStats()
+	if stats != nil {
+		reply["now"] = util.MakeTimestamp()
+		reply["logins"] = stats["withholding"]
+		reply["threshold"] = s.config.Withholding.Threshold
+	}
+
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
@@ -0,0 +1,201 @@
+package archive
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sero-cash/mine-pool/storage"
+	"github.com/sero-cash/mine-pool/util"
+)
+
+type ArchiverConfig struct {
+	Enabled        bool   `json:"enabled"`
+	Interval       string `json:"interval"`
+	HashrateWindow string `json:"hashrateWindow"`
+	// Number of most recent records to keep in redis after archiving, 0 disables trimming
+	KeepBlocks   int64 `json:"keepBlocks"`
+	KeepPayments int64 `json:"keepPayments"`
+}
+
+type Archiver struct {
+	config         *ArchiverConfig
+	backend        *storage.RedisClient
+	db             *storage.PostgresClient
+	hashrateWindow time.Duration
+
+	// Held for the whole archive step, so shutdown never leaves data half moved
+	stepMu  sync.Mutex
+	stopped bool
+}
+
+func NewArchiver(cfg *ArchiverConfig, backend *storage.RedisClient, db *storage.PostgresClient) *Archiver {
+	a := &Archiver{config: cfg, backend: backend, db: db}
+	a.hashrateWindow = util.MustParseDuration(cfg.HashrateWindow)
+	return a
+}
+
+func (a *Archiver) Start() {
+	log.Println("Starting archiver")
+	err := a.db.Migrate()
+	if err != nil {
+		log.Printf("Unable to start archiver, schema migration failed: %v", err)
+		return
+	}
+
+	intv := util.MustParseDuration(a.config.Interval)
+	timer := time.NewTimer(intv)
+	log.Printf("Set archive interval to %v", intv)
+
+	// Immediately archive after start
+	a.step()
+	timer.Reset(intv)
+
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				a.step()
+				timer.Reset(intv)
+			}
+		}
+	}()
+}
+
+func (a *Archiver) step() {
+	a.stepMu.Lock()
+	defer a.stepMu.Unlock()
+	if a.stopped {
+		return
+	}
+	a.archive()
+}
+
+// Waits for current archive step to finish and prevents further ones.
+func (a *Archiver) Stop() {
+	a.stepMu.Lock()
+	defer a.stepMu.Unlock()
+	a.stopped = true
+	log.Println("Archiver stopped")
+}
+
+func (a *Archiver) archive() {
+	start := time.Now()
+	blocks, err := a.archiveBlocks()
+	if err != nil {
+		log.Printf("Failed to archive matured blocks: %v", err)
+		return
+	}
+	payments, maxTimestamp, err := a.archivePayments()
+	if err != nil {
+		log.Printf("Failed to archive payments: %v", err)
+		return
+	}
+	err = a.archiveHashrate()
+	if err != nil {
+		log.Printf("Failed to archive hashrate summary: %v", err)
+	}
+	log.Printf("Archived %v blocks and %v payments, elapsed time %v", blocks, payments, time.Since(start))
+
+	if a.config.KeepBlocks > 0 {
+		n, err := a.trimBlocks()
+		if err != nil {
+			log.Printf("Failed to trim archived blocks from backend: %v", err)
+		} else if n > 0 {
+			log.Printf("Trimmed %v archived blocks from backend", n)
+		}
+	}
+	if a.config.KeepPayments > 0 {
+		n, err := a.backend.TrimPayments(a.config.KeepPayments, maxTimestamp)
+		if err != nil {
+			log.Printf("Failed to trim archived payments from backend: %v", err)
+		} else if n > 0 {
+			log.Printf("Trimmed %v archived payments from backend", n)
+		}
+	}
+}
+
+// Returns number of blocks written.
+func (a *Archiver) archiveBlocks() (int, error) {
+	lastHeight, err := a.db.LastBlockHeight()
+	if err != nil {
+		return 0, err
+	}
+	// Blocks at the last height are fetched again, there may be several of them
+	blocks, err := a.backend.GetMaturedBlocks(lastHeight)
+	if err != nil {
+		return 0, err
+	}
+	for i, block := range blocks {
+		if err := a.archiveBlock(block); err != nil {
+			return i, err
+		}
+	}
+	return len(blocks), nil
+}
+
+func (a *Archiver) archiveBlock(block *storage.BlockData) error {
+	credits, err := a.backend.GetBlockCredits(block.Height, block.Hash)
+	if err != nil {
+		return err
+	}
+	return a.db.WriteBlock(block, credits)
+}
+
+// Drops blocks beyond the kept ones from backend once they are in the archive. Block which matured
+// after a higher one was archived is below the resume height of archiveBlocks, it is archived here first.
+func (a *Archiver) trimBlocks() (int, error) {
+	blocks, err := a.backend.GetOldestMaturedBlocks(a.config.KeepBlocks)
+	if err != nil {
+		return 0, err
+	}
+	archived := make([]*storage.BlockData, 0, len(blocks))
+	for _, block := range blocks {
+		var exists bool
+		exists, err = a.db.HasBlock(block)
+		if err != nil {
+			break
+		}
+		if !exists {
+			if err = a.archiveBlock(block); err != nil {
+				break
+			}
+			log.Printf("Archived late matured block %v %v", block.Height, block.Hash)
+		}
+		archived = append(archived, block)
+	}
+	// Blocks checked before failure are still trimmed
+	if trimErr := a.backend.TrimMaturedBlocks(archived); trimErr != nil {
+		return 0, trimErr
+	}
+	return len(archived), err
+}
+
+// Returns number of payments written and the latest timestamp known to be archived.
+func (a *Archiver) archivePayments() (int, int64, error) {
+	lastTimestamp, err := a.db.LastPaymentTimestamp()
+	if err != nil {
+		return 0, 0, err
+	}
+	payments, err := a.backend.GetPaymentsSince(lastTimestamp)
+	if err != nil {
+		return 0, lastTimestamp, err
+	}
+	if len(payments) == 0 {
+		return 0, lastTimestamp, nil
+	}
+	err = a.db.WritePayments(payments)
+	if err != nil {
+		return 0, lastTimestamp, err
+	}
+	return len(payments), payments[len(payments)-1].Timestamp, nil
+}
+
+func (a *Archiver) archiveHashrate() error {
+	total, miners, err := a.backend.GetHashrateSnapshot(a.hashrateWindow)
+	if err != nil {
+		return err
+	}
+	miners[""] = total
+	return a.db.WriteHashrateSamples(time.Now(), miners)
+}
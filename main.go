@@ -8,8 +8,10 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/sero-cash/go-czero-import/superzk"
@@ -17,35 +19,26 @@ import (
 	"github.com/yvasiyarov/gorelic"
 
 	"github.com/sero-cash/mine-pool/api"
+	"github.com/sero-cash/mine-pool/archive"
 	"github.com/sero-cash/mine-pool/payouts"
 	"github.com/sero-cash/mine-pool/proxy"
 	"github.com/sero-cash/mine-pool/storage"
+	"github.com/sero-cash/mine-pool/util"
 )
 
 var enablePprof = flag.Bool("pprof", false, "Enable the pprof HTTP server")
 
+const defaultShutdownTimeout = 10 * time.Second
+
 var cfg proxy.Config
 var backend *storage.RedisClient
+var archiveDb *storage.PostgresClient
 
-func startProxy() {
-	s := proxy.NewProxy(&cfg, backend)
-	s.Start()
-}
-
-func startApi() {
-	s := api.NewApiServer(&cfg.Api, backend)
-	s.Start()
-}
-
-func startBlockUnlocker() {
-	u := payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend)
-	u.Start()
-}
-
-func startPayoutsProcessor() {
-	u := payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
-	u.Start()
-}
+var proxyServer *proxy.ProxyServer
+var apiServer *api.ApiServer
+var unlocker *payouts.BlockUnlocker
+var payer *payouts.PayoutsProcessor
+var archiver *archive.Archiver
 
 func startNewrelic() {
 	if cfg.NewrelicEnabled {
@@ -57,29 +50,91 @@ func startNewrelic() {
 	}
 }
 
-func readConfig(cfg *proxy.Config) {
-	configFileName := "config.json"
-	if len(os.Args) > 1 {
-		configFileName = os.Args[1]
+func readConfig(cfg *proxy.Config, configFileName string) {
+	if err := loadConfig(cfg, configFileName); err != nil {
+		log.Fatal("Config error: ", err.Error())
 	}
+}
+
+func loadConfig(cfg *proxy.Config, configFileName string) error {
 	configFileName, _ = filepath.Abs(configFileName)
 	log.Printf("Loading config: %v", configFileName)
 
 	configFile, err := os.Open(configFileName)
 	if err != nil {
-		log.Fatal("File error: ", err.Error())
+		return err
 	}
 	defer configFile.Close()
 	jsonParser := json.NewDecoder(configFile)
-	if err := jsonParser.Decode(&cfg); err != nil {
-		log.Fatal("Config error: ", err.Error())
+	return jsonParser.Decode(&cfg)
+}
+
+// Applies safe sections of updated config file to running modules.
+func reloadConfig(configFileName string) {
+	var newCfg proxy.Config
+	if err := loadConfig(&newCfg, configFileName); err != nil {
+		log.Printf("Config reload failed: %v", err)
+		return
+	}
+	if proxyServer != nil {
+		if err := proxyServer.Reload(&newCfg); err != nil {
+			log.Printf("Proxy config reload failed: %v", err)
+		}
+	}
+	if apiServer != nil {
+		if err := apiServer.Reload(&newCfg.Api); err != nil {
+			log.Printf("API config reload failed: %v", err)
+		}
+	}
+	log.Println("Config reload complete")
+}
+
+// Stops modules writing to backend one by one, letting them finish what they are doing.
+func shutdown(timeout time.Duration) {
+	if proxyServer != nil {
+		proxyServer.Stop(timeout)
+	}
+	if unlocker != nil {
+		unlocker.Stop()
+	}
+	if payer != nil {
+		payer.Stop()
+	}
+	if archiver != nil {
+		archiver.Stop()
+	}
+	if err := backend.Close(); err != nil {
+		log.Printf("Failed to close backend: %v", err)
+	}
+	if archiveDb != nil {
+		if err := archiveDb.Close(); err != nil {
+			log.Printf("Failed to close archive database: %v", err)
+		}
 	}
+	log.Println("Shutdown complete")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		runVerify(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "release" {
+		runRelease(os.Args[2:])
+		return
+	}
+
 	superzk.ZeroInit_NoCircuit()
 
-	readConfig(&cfg)
+	configFileName := "config.json"
+	if len(os.Args) > 1 {
+		configFileName = os.Args[1]
+	}
+	readConfig(&cfg, configFileName)
 
 	rand.Seed(time.Now().UnixNano())
 
@@ -96,20 +151,63 @@ func main() {
 		log.Printf("Can't establish connection to backend: %v", err)
 	} else {
 		log.Printf("Backend check reply: %v", pong)
+		if err = backend.CheckSchema(); err != nil {
+			log.Fatalf("Storage schema check failed: %v", err)
+		}
+	}
+
+	if cfg.Postgres.Enabled {
+		archiveDb, err = storage.NewPostgresClient(&cfg.Postgres)
+		if err != nil {
+			log.Fatalf("Can't configure archive database: %v", err)
+		}
+		if err = archiveDb.Check(); err != nil {
+			log.Printf("Can't establish connection to archive database: %v", err)
+		}
+	}
+
+	shutdownTimeout := defaultShutdownTimeout
+	if len(cfg.ShutdownTimeout) > 0 {
+		shutdownTimeout = util.MustParseDuration(cfg.ShutdownTimeout)
 	}
 
 	if cfg.Proxy.Enabled {
-		go startProxy()
+		proxyServer = proxy.NewProxy(&cfg, backend)
+		go proxyServer.Start()
 	}
 	if cfg.Api.Enabled {
-		go startApi()
+		apiServer = api.NewApiServer(&cfg.Api, backend, archiveDb)
+		go apiServer.Start()
 	}
 	if cfg.BlockUnlocker.Enabled {
-		go startBlockUnlocker()
+		unlocker = payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend)
+		go unlocker.Start()
 	}
 	if cfg.Payouts.Enabled {
-		go startPayoutsProcessor()
+		payer = payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
+		go payer.Start()
+	}
+	if cfg.Archiver.Enabled {
+		if archiveDb == nil {
+			log.Fatal("Archiver requires postgres to be enabled")
+		}
+		archiver = archive.NewArchiver(&cfg.Archiver, backend, archiveDb)
+		go archiver.Start()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			reloadConfig(configFileName)
+			continue
+		}
+		log.Printf("Received %v, shutting down", sig)
+		go func() {
+			<-sigs
+			log.Fatal("Forced shutdown")
+		}()
+		shutdown(shutdownTimeout)
+		return
 	}
-	quit := make(chan bool)
-	<-quit
 }
@@ -0,0 +1,34 @@
+// +build go1.9
+
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/sero-cash/mine-pool/storage"
+)
+
+// Usage: mine-pool migrate [-dry-run] [config.json]
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Report pending migrations without changing any data")
+	flags.Parse(args)
+
+	configFileName := "config.json"
+	if flags.NArg() > 0 {
+		configFileName = flags.Arg(0)
+	}
+	readConfig(&cfg, configFileName)
+
+	backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+	if _, err := backend.Check(); err != nil {
+		log.Fatalf("Can't establish connection to backend: %v", err)
+	}
+	if *dryRun {
+		log.Printf("Dry run, no data will be changed")
+	}
+	if err := backend.Migrate(*dryRun); err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+}
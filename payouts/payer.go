@@ -6,6 +6,7 @@ import (
 	"math/big"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/btcsuite/btcutil/base58"
@@ -34,6 +35,8 @@ type PayoutsConfig struct {
 	// In Shannon
 	Threshold int64 `json:"threshold"`
 	BgSave    bool  `json:"bgsave"`
+
+	Withholding WithholdingConfig `json:"withholding"`
 }
 
 func (self PayoutsConfig) GasHex() string {
@@ -52,6 +55,10 @@ type PayoutsProcessor struct {
 	rpc      *rpc.RPCClient
 	halt     bool
 	lastFail error
+
+	// Held for the whole payout step, so shutdown never interrupts sending
+	stepMu  sync.Mutex
+	stopped bool
 }
 
 func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
@@ -105,28 +112,42 @@ func (u *PayoutsProcessor) Start() {
 	}
 
 	// Immediately process payouts after start
-	if u.config.Exchange {
-		u.exhcange_process()
-	} else {
-		u.process()
-	}
+	u.step()
 	timer.Reset(intv)
 
 	go func() {
 		for {
 			select {
 			case <-timer.C:
-				if u.config.Exchange {
-					u.exhcange_process()
-				} else {
-					u.process()
-				}
+				u.step()
 				timer.Reset(intv)
 			}
 		}
 	}()
 }
 
+func (u *PayoutsProcessor) step() {
+	u.stepMu.Lock()
+	defer u.stepMu.Unlock()
+	if u.stopped {
+		return
+	}
+	u.holdWithholders()
+	if u.config.Exchange {
+		u.exhcange_process()
+	} else {
+		u.process()
+	}
+}
+
+// Waits for current payout step to finish and prevents further ones.
+func (u *PayoutsProcessor) Stop() {
+	u.stepMu.Lock()
+	defer u.stepMu.Unlock()
+	u.stopped = true
+	log.Println("Payouts stopped")
+}
+
 func hexToInt64(hex string) int64 {
 	n := new(big.Int)
 	n, _ = n.SetString(hex[2:], 16)
@@ -159,6 +180,9 @@ func (u *PayoutsProcessor) process() {
 			log.Printf("%v ammount %d not reach threshold", login, amountInShannon)
 			continue
 		}
+		if u.isHeld(login) {
+			continue
+		}
 		mustPay++
 
 		// Require active peers before processing
@@ -316,6 +340,9 @@ func (u *PayoutsProcessor) exhcange_process() {
 			log.Printf("%v ammount %d not reach threshold", login, amountInShannon)
 			continue
 		}
+		if u.isHeld(login) {
+			continue
+		}
 		totalAmount = new(big.Int).Add(totalAmount, amountInShannon)
 		mustPayMiners = append(mustPayMiners, payInfo{login, amountInWei, amountInShannon.Int64()})
 
@@ -465,7 +492,7 @@ func (u *PayoutsProcessor) exhcange_process() {
 	}
 }
 
-func (self PayoutsProcessor) isUnlockedAccount() bool {
+func (self *PayoutsProcessor) isUnlockedAccount() bool {
 	reply, err := self.rpc.AddressUnlocked(self.config.Address)
 	if err != nil {
 		log.Println("Unable to process payouts:", err)
@@ -474,7 +501,7 @@ func (self PayoutsProcessor) isUnlockedAccount() bool {
 	return reply
 }
 
-func (self PayoutsProcessor) checkPeers() bool {
+func (self *PayoutsProcessor) checkPeers() bool {
 	n, err := self.rpc.GetPeerCount()
 	if err != nil {
 		log.Println("Unable to start payouts, failed to retrieve number of peers from node:", err)
@@ -487,7 +514,20 @@ func (self PayoutsProcessor) checkPeers() bool {
 	return true
 }
 
-func (self PayoutsProcessor) reachedThreshold(amount *big.Int) bool {
+// Payouts held for suspected block withholding wait for operator, backend failure counts as held.
+func (u *PayoutsProcessor) isHeld(login string) bool {
+	held, err := u.backend.IsPayoutHeld(login)
+	if err != nil {
+		log.Printf("Failed to check payout hold of %v: %v", login, err)
+		return true
+	}
+	if held {
+		log.Printf("Payouts of %v are held", login)
+	}
+	return held
+}
+
+func (self *PayoutsProcessor) reachedThreshold(amount *big.Int) bool {
 	return big.NewInt(self.config.Threshold).Cmp(amount) < 0
 }
 
@@ -499,7 +539,7 @@ func formatPendingPayments(list []*storage.PendingPayment) string {
 	return s
 }
 
-func (self PayoutsProcessor) bgSave() {
+func (self *PayoutsProcessor) bgSave() {
 	result, err := self.backend.BgSave()
 	if err != nil {
 		log.Println("Failed to perform BGSAVE on backend:", err)
@@ -508,7 +548,7 @@ func (self PayoutsProcessor) bgSave() {
 	log.Println("Saving backend state to disk:", result)
 }
 
-func (self PayoutsProcessor) resolvePayouts() {
+func (self *PayoutsProcessor) resolvePayouts() {
 	payments := self.backend.GetPendingPayments()
 
 	if len(payments) > 0 {
@@ -537,7 +577,7 @@ func (self PayoutsProcessor) resolvePayouts() {
 	log.Println("Payouts unlocked")
 }
 
-func (self PayoutsProcessor) resolveExchangePayouts() {
+func (self *PayoutsProcessor) resolveExchangePayouts() {
 	payments := self.backend.GetPendingExchangePayments()
 	if len(payments) > 0 {
 		log.Printf("Will credit back following balances:\n%s", formatPendingPayments(payments))
@@ -565,7 +605,7 @@ func (self PayoutsProcessor) resolveExchangePayouts() {
 	log.Println("Payouts unlocked")
 }
 
-func (self PayoutsProcessor) mustResolvePayout() bool {
+func (self *PayoutsProcessor) mustResolvePayout() bool {
 	v, _ := strconv.ParseBool(os.Getenv("RESOLVE_PAYOUT"))
 	return v
 }
@@ -6,6 +6,7 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sero-cash/go-czero-import/seroparam"
@@ -36,6 +37,10 @@ type BlockUnlocker struct {
 	rpc      *rpc.RPCClient
 	halt     bool
 	lastFail error
+
+	// Held for the whole unlock step, so shutdown never interrupts crediting
+	stepMu  sync.Mutex
+	stopped bool
 }
 
 func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockUnlocker {
@@ -60,22 +65,38 @@ func (u *BlockUnlocker) Start() {
 	log.Printf("Set block unlock interval to %v", intv)
 
 	// Immediately unlock after start
-	u.unlockPendingBlocks()
-	u.unlockAndCreditMiners()
+	u.step()
 	timer.Reset(intv)
 
 	go func() {
 		for {
 			select {
 			case <-timer.C:
-				u.unlockPendingBlocks()
-				u.unlockAndCreditMiners()
+				u.step()
 				timer.Reset(intv)
 			}
 		}
 	}()
 }
 
+func (u *BlockUnlocker) step() {
+	u.stepMu.Lock()
+	defer u.stepMu.Unlock()
+	if u.stopped {
+		return
+	}
+	u.unlockPendingBlocks()
+	u.unlockAndCreditMiners()
+}
+
+// Waits for current unlock step to finish and prevents further ones.
+func (u *BlockUnlocker) Stop() {
+	u.stepMu.Lock()
+	defer u.stepMu.Unlock()
+	u.stopped = true
+	log.Println("Block unlocker stopped")
+}
+
 type UnlockResult struct {
 	maturedBlocks  []*storage.BlockData
 	orphanedBlocks []*storage.BlockData
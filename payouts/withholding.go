@@ -0,0 +1,45 @@
+package payouts
+
+import (
+	"log"
+
+	"github.com/sero-cash/mine-pool/util"
+)
+
+// Holds payouts of logins suspected of block withholding until operator releases them
+type WithholdingConfig struct {
+	HoldPayouts bool `json:"holdPayouts"`
+	// Login is held when chance of honest miner finding this few blocks falls below it
+	Threshold float64 `json:"threshold"`
+	// Logins expected to find fewer blocks are not judged
+	MinExpected float64 `json:"minExpected"`
+}
+
+// Runs before every payout step, so new suspects are held before they get paid.
+func (u *PayoutsProcessor) holdWithholders() {
+	cfg := u.config.Withholding
+	if !cfg.HoldPayouts {
+		return
+	}
+	expectations, err := u.backend.GetBlockExpectations(cfg.MinExpected)
+	if err != nil {
+		log.Printf("Failed to fetch block expectations from backend: %v", err)
+		return
+	}
+	for _, e := range expectations {
+		probability := util.PoissonCDF(e.Found, e.Expected)
+		if probability >= cfg.Threshold {
+			continue
+		}
+		// Existing hold, including released one, is left as is
+		held, err := u.backend.HoldPayouts(e.Login, "withholding")
+		if err != nil {
+			log.Printf("Failed to hold payouts of %s: %v", e.Login, err)
+			continue
+		}
+		if held {
+			log.Printf("Holding payouts of %s for suspected block withholding, found %v of %.2f expected blocks, probability %.2e",
+				e.Login, e.Found, e.Expected, probability)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package policy
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/sero-cash/mine-pool/util"
+)
+
+// Policies applied per miner address, regardless of IPs it comes from
+type Logins struct {
+	Enabled bool `json:"enabled"`
+	// Concurrent stratum and websocket connections of a login on this instance, 0 is unlimited.
+	// Connections are not counted across instances nor by worker id.
+	MaxWorkers     int     `json:"maxWorkers"`
+	InvalidPercent float32 `json:"invalidPercent"`
+	CheckThreshold int32   `json:"checkThreshold"`
+	MalformedLimit int32   `json:"malformedLimit"`
+	// Login is refused for this long once it crossed a threshold
+	SuspendFor string `json:"suspendFor"`
+}
+
+func (l *Logins) suspendFor() (time.Duration, error) {
+	if !l.Enabled {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(l.SuspendFor)
+	if err != nil {
+		return 0, fmt.Errorf("invalid logins suspendFor: %v", err)
+	}
+	return d, nil
+}
+
+func (s *PolicyServer) getLogin(login string) *Stats {
+	s.loginsMu.Lock()
+	defer s.loginsMu.Unlock()
+
+	x, ok := s.logins[login]
+	if !ok {
+		x = &Stats{}
+		s.logins[login] = x
+	}
+	x.heartbeat()
+	return x
+}
+
+func (s *PolicyServer) IsSuspended(login string) bool {
+	if !s.cfg().Logins.Enabled {
+		return false
+	}
+	s.loginsMu.Lock()
+	x, ok := s.logins[login]
+	s.loginsMu.Unlock()
+	if !ok || atomic.LoadInt32(&x.Banned) == 0 {
+		return false
+	}
+	return util.MakeTimestamp()-atomic.LoadInt64(&x.BannedAt) < atomic.LoadInt64(&s.suspendFor)
+}
+
+func (s *PolicyServer) ApplyLoginSharePolicy(login string, validShare bool) bool {
+	if !s.cfg().Logins.Enabled {
+		return true
+	}
+	x := s.getLogin(login)
+	x.Lock()
+
+	if validShare {
+		x.ValidShares++
+	} else {
+		x.InvalidShares++
+	}
+	totalShares := x.ValidShares + x.InvalidShares
+	if totalShares < s.cfg().Logins.CheckThreshold {
+		x.Unlock()
+		return true
+	}
+	validShares := float32(x.ValidShares)
+	invalidShares := float32(x.InvalidShares)
+	x.resetShares()
+	x.Unlock()
+
+	ratio := invalidShares / validShares
+
+	if ratio >= s.cfg().Logins.InvalidPercent/100.0 {
+		s.suspend(x, login, "invalid shares")
+		return false
+	}
+	return true
+}
+
+func (s *PolicyServer) ApplyLoginMalformedPolicy(login string) bool {
+	if !s.cfg().Logins.Enabled {
+		return true
+	}
+	x := s.getLogin(login)
+	if x.incrMalformed() >= s.cfg().Logins.MalformedLimit {
+		s.suspend(x, login, "malformed requests")
+		return false
+	}
+	return true
+}
+
+func (s *PolicyServer) suspend(x *Stats, login, reason string) {
+	atomic.StoreInt64(&x.BannedAt, util.MakeTimestamp())
+	if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
+		log.Printf("Suspended login %v for %v: %s", login, time.Duration(atomic.LoadInt64(&s.suspendFor))*time.Millisecond, reason)
+	}
+}
+
+// Counts stratum worker of login, returns false if login already runs maximum number of them.
+func (s *PolicyServer) AcquireWorker(login string) bool {
+	max := s.cfg().Logins.MaxWorkers
+	s.loginsMu.Lock()
+	defer s.loginsMu.Unlock()
+
+	if s.cfg().Logins.Enabled && max > 0 && s.workers[login] >= max {
+		return false
+	}
+	s.workers[login]++
+	return true
+}
+
+func (s *PolicyServer) ReleaseWorker(login string) {
+	s.loginsMu.Lock()
+	defer s.loginsMu.Unlock()
+
+	if s.workers[login] <= 1 {
+		delete(s.workers, login)
+	} else {
+		s.workers[login]--
+	}
+}
+
+// Drops idle login counters and expired suspensions, logins running workers are kept.
+func (s *PolicyServer) resetLoginStats(now int64) {
+	suspendFor := atomic.LoadInt64(&s.suspendFor)
+	total := 0
+	s.loginsMu.Lock()
+	defer s.loginsMu.Unlock()
+
+	for login, x := range s.logins {
+		if atomic.LoadInt32(&x.Banned) > 0 {
+			if now-atomic.LoadInt64(&x.BannedAt) < suspendFor {
+				continue
+			}
+			if atomic.CompareAndSwapInt32(&x.Banned, 1, 0) {
+				atomic.StoreInt32(&x.Malformed, 0)
+				x.Lock()
+				x.resetShares()
+				x.Unlock()
+				log.Printf("Suspension dropped for login %v", login)
+			}
+		} else if now-atomic.LoadInt64(&x.LastBeat) < s.timeout {
+			continue
+		}
+		if _, ok := s.workers[login]; !ok {
+			delete(s.logins, login)
+			total++
+		}
+	}
+	log.Printf("Flushed stats for %v logins", total)
+}
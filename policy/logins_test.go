@@ -0,0 +1,168 @@
+package policy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sero-cash/mine-pool/util"
+)
+
+const testLogin = "login"
+
+func newLoginsServer(cfg Logins) *PolicyServer {
+	s := &PolicyServer{
+		logins:     make(map[string]*Stats),
+		workers:    make(map[string]int),
+		stats:      make(map[string]*Stats),
+		suspendFor: int64(30 * time.Minute / time.Millisecond),
+		timeout:    int64(time.Hour / time.Millisecond),
+	}
+	s.config.Store(&Config{Logins: cfg})
+	return s
+}
+
+func TestLoginSuspension(t *testing.T) {
+	s := newLoginsServer(Logins{Enabled: true, InvalidPercent: 50, CheckThreshold: 4, MalformedLimit: 3})
+
+	for i := 0; i < 2; i++ {
+		if !s.ApplyLoginMalformedPolicy(testLogin) {
+			t.Fatal("Login must not be suspended below malformed limit")
+		}
+	}
+	if s.IsSuspended(testLogin) {
+		t.Error("Login must not be suspended below malformed limit")
+	}
+	if s.ApplyLoginMalformedPolicy(testLogin) {
+		t.Error("Login must be suspended at malformed limit")
+	}
+	if !s.IsSuspended(testLogin) || s.IsSuspended("other") {
+		t.Error("Only offending login must be suspended")
+	}
+
+	// Suspension ends once window passed, even before stats are reset
+	x := s.logins[testLogin]
+	atomic.StoreInt64(&x.BannedAt, util.MakeTimestamp()-s.suspendFor-1)
+	if s.IsSuspended(testLogin) {
+		t.Error("Suspension must end after suspendFor")
+	}
+
+	s = newLoginsServer(Logins{Enabled: true, InvalidPercent: 50, CheckThreshold: 4, MalformedLimit: 100})
+	for i, valid := range []bool{true, true, false} {
+		if !s.ApplyLoginSharePolicy(testLogin, valid) {
+			t.Fatalf("Login must not be checked below threshold, share %v", i)
+		}
+	}
+	if s.ApplyLoginSharePolicy(testLogin, false) || !s.IsSuspended(testLogin) {
+		t.Error("Login must be suspended once invalid ratio reaches limit")
+	}
+
+	s = newLoginsServer(Logins{Enabled: false, MalformedLimit: 1})
+	if !s.ApplyLoginMalformedPolicy(testLogin) || s.IsSuspended(testLogin) {
+		t.Error("Disabled policy must not suspend")
+	}
+}
+
+func TestApplyLoginPolicy(t *testing.T) {
+	s := newLoginsServer(Logins{Enabled: true, MalformedLimit: 1})
+	s.blacklist = []string{"blacklisted"}
+	s.ApplyLoginMalformedPolicy(testLogin)
+
+	tests := []struct {
+		login string
+		err   error
+	}{
+		{"other", nil},
+		{testLogin, ErrLoginSuspended},
+		{"blacklisted", ErrLoginBlacklisted},
+	}
+	for _, test := range tests {
+		if err := s.ApplyLoginPolicy(test.login, "192.0.2.1"); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.login, test.err, err)
+		}
+	}
+
+	// Login is accepted again once suspension ended
+	atomic.StoreInt64(&s.logins[testLogin].BannedAt, util.MakeTimestamp()-s.suspendFor-1)
+	if err := s.ApplyLoginPolicy(testLogin, "192.0.2.1"); err != nil {
+		t.Errorf("Login must be accepted after suspension, got %v", err)
+	}
+}
+
+func TestResetLoginStats(t *testing.T) {
+	s := newLoginsServer(Logins{Enabled: true, MalformedLimit: 1})
+	now := util.MakeTimestamp()
+
+	s.ApplyLoginMalformedPolicy("suspended")
+	s.ApplyLoginMalformedPolicy("expired")
+	atomic.StoreInt64(&s.logins["expired"].BannedAt, now-s.suspendFor-1)
+	s.ApplyLoginMalformedPolicy("working")
+	atomic.StoreInt64(&s.logins["working"].BannedAt, now-s.suspendFor-1)
+	s.AcquireWorker("working")
+	s.getLogin("active")
+	s.getLogin("idle")
+	atomic.StoreInt64(&s.logins["idle"].LastBeat, now-s.timeout-1)
+
+	s.resetLoginStats(now)
+
+	if !s.IsSuspended("suspended") {
+		t.Error("Suspension within window must be kept")
+	}
+	if _, ok := s.logins["expired"]; ok {
+		t.Error("Expired suspension of login without workers must be dropped")
+	}
+	x, ok := s.logins["working"]
+	if !ok {
+		t.Fatal("Login running workers must be kept")
+	}
+	if atomic.LoadInt32(&x.Banned) != 0 || atomic.LoadInt32(&x.Malformed) != 0 {
+		t.Errorf("Expired suspension must be lifted with counters reset: %+v", x)
+	}
+	if _, ok := s.logins["active"]; !ok {
+		t.Error("Recently active login must be kept")
+	}
+	if _, ok := s.logins["idle"]; ok {
+		t.Error("Idle login must be dropped")
+	}
+}
+
+func TestAcquireReleaseWorker(t *testing.T) {
+	s := newLoginsServer(Logins{Enabled: true, MaxWorkers: 2})
+
+	if !s.AcquireWorker("a") || !s.AcquireWorker("a") {
+		t.Fatal("Workers within limit must be accepted")
+	}
+	if s.AcquireWorker("a") {
+		t.Error("Worker over limit must be refused")
+	}
+
+	// Session switches from a to b, as stratum login does
+	if !s.AcquireWorker("b") {
+		t.Fatal("Worker of other login must be accepted")
+	}
+	s.ReleaseWorker("a")
+	if s.workers["a"] != 1 || s.workers["b"] != 1 {
+		t.Errorf("Login switch must move one worker, got %v", s.workers)
+	}
+	if !s.AcquireWorker("a") {
+		t.Error("Released slot must be available again")
+	}
+
+	// Disconnect of every session
+	s.ReleaseWorker("a")
+	s.ReleaseWorker("a")
+	s.ReleaseWorker("b")
+	if len(s.workers) != 0 {
+		t.Errorf("All workers must be released, got %v", s.workers)
+	}
+	// Extra release of session which never logged in must not go negative
+	s.ReleaseWorker("a")
+	if n, ok := s.workers["a"]; ok {
+		t.Errorf("Released login must not be counted, got %v", n)
+	}
+
+	s = newLoginsServer(Logins{Enabled: false, MaxWorkers: 1})
+	if !s.AcquireWorker("a") || !s.AcquireWorker("a") {
+		t.Error("Disabled policy must not limit workers")
+	}
+}
@@ -1,6 +1,7 @@
 package policy
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os/exec"
@@ -14,11 +15,13 @@ import (
 )
 
 type Config struct {
-	Workers         int     `json:"workers"`
-	Banning         Banning `json:"banning"`
-	Limits          Limits  `json:"limits"`
-	ResetInterval   string  `json:"resetInterval"`
-	RefreshInterval string  `json:"refreshInterval"`
+	Workers         int        `json:"workers"`
+	Banning         Banning    `json:"banning"`
+	Limits          Limits     `json:"limits"`
+	RateLimits      RateLimits `json:"rateLimits"`
+	Logins          Logins     `json:"logins"`
+	ResetInterval   string     `json:"resetInterval"`
+	RefreshInterval string     `json:"refreshInterval"`
 }
 
 type Limits struct {
@@ -35,6 +38,17 @@ type Banning struct {
 	InvalidPercent float32 `json:"invalidPercent"`
 	CheckThreshold int32   `json:"checkThreshold"`
 	MalformedLimit int32   `json:"malformedLimit"`
+	// Also count malformed requests and invalid shares per /24 IPv4 and /64 IPv6 subnet and ban whole subnet
+	Subnets              bool  `json:"subnets"`
+	SubnetMalformedLimit int32 `json:"subnetMalformedLimit"`
+	SubnetCheckThreshold int32 `json:"subnetCheckThreshold"`
+}
+
+func (b *Banning) check() error {
+	if b.Subnets && (b.SubnetMalformedLimit <= 0 || b.SubnetCheckThreshold <= 0) {
+		return errors.New("subnet banning requires positive subnetMalformedLimit and subnetCheckThreshold")
+	}
+	return nil
 }
 
 type Stats struct {
@@ -48,39 +62,88 @@ type Stats struct {
 	Malformed     int32
 	ConnLimit     int32
 	Banned        int32
+
+	connBucket    TokenBucket
+	getWorkBucket TokenBucket
 }
 
+// Reasons of bans
+const (
+	banBlacklisted = "blacklisted login"
+	banMalformed   = "malformed requests"
+	banInvalid     = "invalid shares"
+	banManual      = "manual"
+	banConnRate    = "connection rate"
+	banRequestRate = "request rate"
+	banGetWorkRate = "getwork rate"
+	// Subnet bans
+	banSubnetMalformed = "malformed requests from subnet"
+	banSubnetInvalid   = "invalid shares from subnet"
+)
+
 type PolicyServer struct {
 	sync.RWMutex
 	statsMu    sync.Mutex
-	config     *Config
+	config     atomic.Value
 	stats      map[string]*Stats
-	banChannel chan string
+	banChannel chan *storage.Ban
 	startedAt  int64
 	grace      int64
 	timeout    int64
 	blacklist  []string
-	whitelist  []string
-	storage    *storage.RedisClient
+	// Address ranges
+	whitelist   *util.IPTrie
+	ipBlacklist *util.IPTrie
+	storage     *storage.RedisClient
+
+	// Bans of all instances by IP with expiration time
+	bans     map[string]int64
+	quit     chan struct{}
+	stopOnce sync.Once
+
+	// Per login counters and stratum workers
+	loginsMu   sync.Mutex
+	logins     map[string]*Stats
+	workers    map[string]int
+	suspendFor int64
 }
 
-func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
-	s := &PolicyServer{config: cfg, startedAt: util.MakeTimestamp()}
+func Start(cfg *Config, backend *storage.RedisClient) *PolicyServer {
+	if err := cfg.Banning.check(); err != nil {
+		log.Fatalf("Invalid policy config: %v", err)
+	}
+	if err := cfg.RateLimits.check(); err != nil {
+		log.Fatalf("Invalid policy config: %v", err)
+	}
+	suspendFor, err := cfg.Logins.suspendFor()
+	if err != nil {
+		log.Fatalf("Invalid policy config: %v", err)
+	}
+	s := &PolicyServer{startedAt: util.MakeTimestamp()}
+	s.config.Store(cfg)
 	grace := util.MustParseDuration(cfg.Limits.Grace)
 	s.grace = int64(grace / time.Millisecond)
-	s.banChannel = make(chan string, 64)
+	s.suspendFor = int64(suspendFor / time.Millisecond)
+	s.logins = make(map[string]*Stats)
+	s.workers = make(map[string]int)
+	s.banChannel = make(chan *storage.Ban, 64)
 	s.stats = make(map[string]*Stats)
-	s.storage = storage
+	s.bans = make(map[string]int64)
+	s.quit = make(chan struct{})
+	s.whitelist = util.NewIPTrie()
+	s.ipBlacklist = util.NewIPTrie()
+	s.storage = backend
 	s.refreshState()
+	go s.subscribeBans()
 
-	timeout := util.MustParseDuration(s.config.ResetInterval)
+	timeout := util.MustParseDuration(cfg.ResetInterval)
 	s.timeout = int64(timeout / time.Millisecond)
 
-	resetIntv := util.MustParseDuration(s.config.ResetInterval)
+	resetIntv := util.MustParseDuration(cfg.ResetInterval)
 	resetTimer := time.NewTimer(resetIntv)
 	log.Printf("Set policy stats reset every %v", resetIntv)
 
-	refreshIntv := util.MustParseDuration(s.config.RefreshInterval)
+	refreshIntv := util.MustParseDuration(cfg.RefreshInterval)
 	refreshTimer := time.NewTimer(refreshIntv)
 	log.Printf("Set policy state refresh every %v", refreshIntv)
 
@@ -97,19 +160,51 @@ func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
 		}
 	}()
 
-	for i := 0; i < s.config.Workers; i++ {
+	for i := 0; i < cfg.Workers; i++ {
 		s.startPolicyWorker()
 	}
-	log.Printf("Running with %v policy workers", s.config.Workers)
+	log.Printf("Running with %v policy workers", cfg.Workers)
 	return s
 }
 
+func (s *PolicyServer) cfg() *Config {
+	return s.config.Load().(*Config)
+}
+
+// Applies new banning, limits and rate limits thresholds, workers and intervals are kept until restart.
+func (s *PolicyServer) Reload(cfg *Config) error {
+	grace, err := time.ParseDuration(cfg.Limits.Grace)
+	if err != nil {
+		return fmt.Errorf("invalid limits grace: %v", err)
+	}
+	if err := cfg.Banning.check(); err != nil {
+		return err
+	}
+	if err := cfg.RateLimits.check(); err != nil {
+		return err
+	}
+	suspendFor, err := cfg.Logins.suspendFor()
+	if err != nil {
+		return err
+	}
+	current := *s.cfg()
+	current.Banning = cfg.Banning
+	current.Limits = cfg.Limits
+	current.RateLimits = cfg.RateLimits
+	current.Logins = cfg.Logins
+	s.config.Store(&current)
+	atomic.StoreInt64(&s.grace, int64(grace/time.Millisecond))
+	atomic.StoreInt64(&s.suspendFor, int64(suspendFor/time.Millisecond))
+	log.Printf("Reloaded policy thresholds")
+	return nil
+}
+
 func (s *PolicyServer) startPolicyWorker() {
 	go func() {
 		for {
 			select {
-			case ip := <-s.banChannel:
-				s.doBan(ip)
+			case ban := <-s.banChannel:
+				s.doBan(ban)
 			}
 		}
 	}()
@@ -117,7 +212,7 @@ func (s *PolicyServer) startPolicyWorker() {
 
 func (s *PolicyServer) resetStats() {
 	now := util.MakeTimestamp()
-	banningTimeout := s.config.Banning.Timeout * 1000
+	banningTimeout := s.cfg().Banning.Timeout * 1000
 	total := 0
 	s.statsMu.Lock()
 	defer s.statsMu.Unlock()
@@ -140,6 +235,7 @@ func (s *PolicyServer) resetStats() {
 		}
 	}
 	log.Printf("Flushed stats for %v IP addresses", total)
+	s.resetLoginStats(now)
 }
 
 func (s *PolicyServer) refreshState() {
@@ -151,16 +247,82 @@ func (s *PolicyServer) refreshState() {
 	if err != nil {
 		log.Printf("Failed to get blacklist from backend: %v", err)
 	}
-	s.whitelist, err = s.storage.GetWhitelist()
+	whitelist, err := s.storage.GetWhitelist()
 	if err != nil {
 		log.Printf("Failed to get whitelist from backend: %v", err)
+	} else {
+		s.whitelist = newIPTrie("whitelist", whitelist)
+	}
+	ipBlacklist, err := s.storage.GetIPBlacklist()
+	if err != nil {
+		log.Printf("Failed to get IP blacklist from backend: %v", err)
+	} else {
+		s.ipBlacklist = newIPTrie("IP blacklist", ipBlacklist)
+	}
+	bans, err := s.storage.GetBans()
+	if err != nil {
+		log.Printf("Failed to get bans from backend: %v", err)
+	} else {
+		s.bans = make(map[string]int64, len(bans))
+		for _, ban := range bans {
+			s.bans[ban.IP] = ban.ExpiresAt
+		}
 	}
 	log.Println("Policy state refresh complete")
 }
 
+func newIPTrie(name string, entries []string) *util.IPTrie {
+	trie := util.NewIPTrie()
+	for _, v := range entries {
+		if err := trie.Insert(v); err != nil {
+			log.Printf("Skipping invalid %s entry %q: %v", name, v, err)
+		}
+	}
+	return trie
+}
+
+// Applies bans of other instances as soon as they are announced.
+func (s *PolicyServer) subscribeBans() {
+	for {
+		err := s.storage.SubscribeBans(s.applySharedBan, s.quit)
+		if err == nil {
+			return
+		}
+		log.Printf("Ban subscription failed: %v", err)
+		select {
+		case <-s.quit:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// Stops listening to bans of other instances.
+func (s *PolicyServer) Stop() {
+	s.stopOnce.Do(func() { close(s.quit) })
+}
+
+func (s *PolicyServer) applySharedBan(ban *storage.Ban) {
+	s.Lock()
+	s.bans[ban.IP] = ban.ExpiresAt
+	s.Unlock()
+
+	// Firewall of this host is updated unless the ban is our own
+	s.statsMu.Lock()
+	x, ok := s.stats[ban.IP]
+	s.statsMu.Unlock()
+	if ok && atomic.LoadInt32(&x.Banned) > 0 {
+		return
+	}
+	if set := s.cfg().Banning.IPSet; len(set) > 0 && s.cfg().Banning.Enabled {
+		s.doIPSet(ban.IP)
+	}
+	log.Printf("Banned %v by another instance: %s", ban.IP, ban.Reason)
+}
+
 func (s *PolicyServer) NewStats() *Stats {
 	x := &Stats{
-		ConnLimit: s.config.Limits.Limit,
+		ConnLimit: s.cfg().Limits.Limit,
 	}
 	x.heartbeat()
 	return x
@@ -182,61 +344,126 @@ func (s *PolicyServer) Get(ip string) *Stats {
 
 func (s *PolicyServer) BanClient(ip string) {
 	x := s.Get(ip)
-	s.forceBan(x, ip)
+	s.forceBan(x, ip, banManual)
 }
 
 func (s *PolicyServer) IsBanned(ip string) bool {
+	if s.InIPBlackList(ip) {
+		return true
+	}
 	x := s.Get(ip)
-	return atomic.LoadInt32(&x.Banned) > 0
+	if atomic.LoadInt32(&x.Banned) > 0 {
+		return true
+	}
+	subnet := util.Subnet(ip)
+	if s.subnetBanned(subnet) {
+		return true
+	}
+	s.RLock()
+	defer s.RUnlock()
+	now := util.MakeTimestamp()
+	if expiresAt, ok := s.bans[ip]; ok && expiresAt > now {
+		return true
+	}
+	expiresAt, ok := s.bans[subnet]
+	return ok && expiresAt > now
+}
+
+func (s *PolicyServer) subnetBanned(subnet string) bool {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	x, ok := s.stats[subnet]
+	return ok && atomic.LoadInt32(&x.Banned) > 0
+}
+
+// Returns subnet key of address if subnet policy is enabled
+func (s *PolicyServer) subnet(ip string) string {
+	if !s.cfg().Banning.Subnets {
+		return ""
+	}
+	return util.Subnet(ip)
 }
 
 func (s *PolicyServer) ApplyLimitPolicy(ip string) bool {
-	if !s.config.Limits.Enabled {
+	if !s.cfg().Limits.Enabled {
 		return true
 	}
 	now := util.MakeTimestamp()
-	if now-s.startedAt > s.grace {
+	if now-s.startedAt > atomic.LoadInt64(&s.grace) {
 		return s.Get(ip).decrLimit() > 0
 	}
 	return true
 }
 
-func (s *PolicyServer) ApplyLoginPolicy(addy, ip string) bool {
+// Refused logins, returned by ApplyLoginPolicy
+var (
+	ErrLoginBlacklisted = errors.New("login is blacklisted")
+	ErrLoginSuspended   = errors.New("login is suspended")
+)
+
+// Blacklisted login bans the IP it came from, suspended one is only refused until suspension ends
+func (s *PolicyServer) ApplyLoginPolicy(addy, ip string) error {
 	if s.InBlackList(addy) {
 		x := s.Get(ip)
-		s.forceBan(x, ip)
-		return false
+		s.forceBan(x, ip, banBlacklisted)
+		return ErrLoginBlacklisted
 	}
-	return true
+	if s.IsSuspended(addy) {
+		return ErrLoginSuspended
+	}
+	return nil
 }
 
 func (s *PolicyServer) ApplyMalformedPolicy(ip string) bool {
 	x := s.Get(ip)
 	n := x.incrMalformed()
-	if n >= s.config.Banning.MalformedLimit {
-		s.forceBan(x, ip)
+	if n >= s.cfg().Banning.MalformedLimit {
+		s.forceBan(x, ip, banMalformed)
 		return false
 	}
+	if subnet := s.subnet(ip); len(subnet) > 0 {
+		y := s.Get(subnet)
+		if y.incrMalformed() >= s.cfg().Banning.SubnetMalformedLimit {
+			s.forceBan(y, subnet, banSubnetMalformed)
+			return false
+		}
+	}
 	return true
 }
 
 func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
 	x := s.Get(ip)
+	if validShare && s.cfg().Limits.Enabled {
+		x.incrLimit(s.cfg().Limits.LimitJump)
+	}
+	if s.countShare(x, validShare, s.cfg().Banning.CheckThreshold) {
+		s.forceBan(x, ip, banInvalid)
+		return false
+	}
+	if subnet := s.subnet(ip); len(subnet) > 0 {
+		y := s.Get(subnet)
+		if s.countShare(y, validShare, s.cfg().Banning.SubnetCheckThreshold) {
+			s.forceBan(y, subnet, banSubnetInvalid)
+			return false
+		}
+	}
+	return true
+}
+
+// Counts share, returns true if ratio of invalid shares is too high once threshold is reached
+func (s *PolicyServer) countShare(x *Stats, validShare bool, threshold int32) bool {
 	x.Lock()
 
 	if validShare {
 		x.ValidShares++
-		if s.config.Limits.Enabled {
-			x.incrLimit(s.config.Limits.LimitJump)
-		}
 	} else {
 		x.InvalidShares++
 	}
 
 	totalShares := x.ValidShares + x.InvalidShares
-	if totalShares < s.config.Banning.CheckThreshold {
+	if totalShares < threshold {
 		x.Unlock()
-		return true
+		return false
 	}
 	validShares := float32(x.ValidShares)
 	invalidShares := float32(x.InvalidShares)
@@ -244,12 +471,7 @@ func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
 	x.Unlock()
 
 	ratio := invalidShares / validShares
-
-	if ratio >= s.config.Banning.InvalidPercent/100.0 {
-		s.forceBan(x, ip)
-		return false
-	}
-	return true
+	return ratio >= s.cfg().Banning.InvalidPercent/100.0
 }
 
 func (x *Stats) resetShares() {
@@ -257,17 +479,24 @@ func (x *Stats) resetShares() {
 	x.InvalidShares = 0
 }
 
-func (s *PolicyServer) forceBan(x *Stats, ip string) {
-	if !s.config.Banning.Enabled || s.InWhiteList(ip) {
+func (s *PolicyServer) forceBan(x *Stats, ip, reason string) {
+	if !s.cfg().Banning.Enabled || s.InWhiteList(ip) {
 		return
 	}
-	atomic.StoreInt64(&x.BannedAt, util.MakeTimestamp())
+	now := util.MakeTimestamp()
+	atomic.StoreInt64(&x.BannedAt, now)
 
 	if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
-		if len(s.config.Banning.IPSet) > 0 {
-			s.banChannel <- ip
-		} else {
-			log.Println("Banned peer", ip)
+		ban := &storage.Ban{
+			IP:        ip,
+			Reason:    reason,
+			BannedAt:  now,
+			ExpiresAt: now + s.cfg().Banning.Timeout*1000,
+		}
+		select {
+		case s.banChannel <- ban:
+		default:
+			log.Printf("Ban queue is full, %v is banned on this instance only: %s", ip, reason)
 		}
 	}
 }
@@ -290,14 +519,38 @@ func (s *PolicyServer) InBlackList(addy string) bool {
 	return util.StringInSlice(addy, s.blacklist)
 }
 
+// Accepts address or subnet, subnet is whitelisted if any whitelisted range overlaps it.
 func (s *PolicyServer) InWhiteList(ip string) bool {
 	s.RLock()
 	defer s.RUnlock()
-	return util.StringInSlice(ip, s.whitelist)
+	if strings.Contains(ip, "/") {
+		n, err := util.ParseIPNet(ip)
+		return err == nil && s.whitelist.Overlaps(n)
+	}
+	return s.whitelist.ContainsString(ip)
+}
+
+// Whitelist takes precedence over IP blacklist.
+func (s *PolicyServer) InIPBlackList(ip string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.ipBlacklist.ContainsString(ip) && !s.whitelist.ContainsString(ip)
+}
+
+// Shares ban with other instances and applies it to firewall.
+func (s *PolicyServer) doBan(ban *storage.Ban) {
+	if err := s.storage.WriteBan(ban); err != nil {
+		log.Printf("Failed to share ban of %v: %v", ban.IP, err)
+	}
+	if len(s.cfg().Banning.IPSet) > 0 {
+		s.doIPSet(ban.IP)
+	} else {
+		log.Printf("Banned peer %v: %s", ban.IP, ban.Reason)
+	}
 }
 
-func (s *PolicyServer) doBan(ip string) {
-	set, timeout := s.config.Banning.IPSet, s.config.Banning.Timeout
+func (s *PolicyServer) doIPSet(ip string) {
+	set, timeout := s.cfg().Banning.IPSet, s.cfg().Banning.Timeout
 	cmd := fmt.Sprintf("sudo ipset add %s %s timeout %v -!", set, ip, timeout)
 	args := strings.Fields(cmd)
 	head := args[0]
@@ -0,0 +1,128 @@
+package policy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/yvasiyarov/go-metrics"
+
+	"github.com/sero-cash/mine-pool/util"
+)
+
+// Token bucket limits, whitelisted addresses are not limited
+type RateLimits struct {
+	Enabled bool `json:"enabled"`
+	// New stratum and websocket connections per IP, applied after limits grace
+	Connections Bucket `json:"connections"`
+	// Stratum and websocket requests per session
+	Requests Bucket `json:"requests"`
+	// HTTP getwork calls per IP
+	GetWork Bucket `json:"getWork"`
+}
+
+type Bucket struct {
+	// Tokens per second, 0 disables the limit
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+	// Once bucket is empty: reject, malformed (also counted as malformed request) or ban
+	Penalty string `json:"penalty"`
+}
+
+const (
+	penaltyReject    = "reject"
+	penaltyMalformed = "malformed"
+	penaltyBan       = "ban"
+)
+
+var (
+	connLimited    = metrics.GetOrRegisterCounter("policy.ratelimit.connections", metrics.DefaultRegistry)
+	requestLimited = metrics.GetOrRegisterCounter("policy.ratelimit.requests", metrics.DefaultRegistry)
+	getWorkLimited = metrics.GetOrRegisterCounter("policy.ratelimit.getwork", metrics.DefaultRegistry)
+	rateLimitBans  = metrics.GetOrRegisterCounter("policy.ratelimit.bans", metrics.DefaultRegistry)
+)
+
+func (l *RateLimits) check() error {
+	if !l.Enabled {
+		return nil
+	}
+	for name, b := range map[string]*Bucket{"connections": &l.Connections, "requests": &l.Requests, "getWork": &l.GetWork} {
+		if b.Rate > 0 && b.Burst < 1 {
+			return fmt.Errorf("rate limit %s requires burst of at least 1", name)
+		}
+		switch b.Penalty {
+		case "", penaltyReject, penaltyMalformed, penaltyBan:
+		default:
+			return fmt.Errorf("unknown rate limit %s penalty %q", name, b.Penalty)
+		}
+	}
+	return nil
+}
+
+// Starts full, refills at rate tokens per second up to burst.
+type TokenBucket struct {
+	sync.Mutex
+	tokens float64
+	last   int64
+}
+
+func (b *TokenBucket) take(rate, burst float64, now int64) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.last == 0 {
+		b.tokens = burst
+	} else {
+		b.tokens += float64(now-b.last) / 1000 * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (s *PolicyServer) AllowConnection(ip string) bool {
+	cfg := s.cfg().RateLimits
+	if !cfg.Enabled || util.MakeTimestamp()-s.startedAt <= atomic.LoadInt64(&s.grace) {
+		return true
+	}
+	return s.takeToken(&s.Get(ip).connBucket, &cfg.Connections, ip, connLimited, banConnRate)
+}
+
+// Takes token of session bucket, bucket is kept by caller.
+func (s *PolicyServer) AllowRequest(b *TokenBucket, ip string) bool {
+	cfg := s.cfg().RateLimits
+	if !cfg.Enabled {
+		return true
+	}
+	return s.takeToken(b, &cfg.Requests, ip, requestLimited, banRequestRate)
+}
+
+func (s *PolicyServer) AllowGetWork(ip string) bool {
+	cfg := s.cfg().RateLimits
+	if !cfg.Enabled {
+		return true
+	}
+	return s.takeToken(&s.Get(ip).getWorkBucket, &cfg.GetWork, ip, getWorkLimited, banGetWorkRate)
+}
+
+func (s *PolicyServer) takeToken(b *TokenBucket, limit *Bucket, ip string, limited metrics.Counter, reason string) bool {
+	if limit.Rate <= 0 || b.take(limit.Rate, limit.Burst, util.MakeTimestamp()) || s.InWhiteList(ip) {
+		return true
+	}
+	limited.Inc(1)
+
+	switch limit.Penalty {
+	case penaltyMalformed:
+		s.ApplyMalformedPolicy(ip)
+	case penaltyBan:
+		rateLimitBans.Inc(1)
+		s.forceBan(s.Get(ip), ip, reason)
+	}
+	return false
+}
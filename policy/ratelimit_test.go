@@ -0,0 +1,140 @@
+package policy
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/sero-cash/mine-pool/storage"
+	"github.com/sero-cash/mine-pool/util"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b TokenBucket
+	now := int64(1000000)
+
+	// Starts full
+	for i := 0; i < 3; i++ {
+		if !b.take(2, 3, now) {
+			t.Fatalf("Token %v of full bucket must be taken", i)
+		}
+	}
+	if b.take(2, 3, now) {
+		t.Error("Empty bucket must refuse")
+	}
+
+	// Refills at rate tokens per second
+	if b.take(2, 3, now+400) {
+		t.Error("Bucket must not refill a whole token in 400ms at rate 2")
+	}
+	if !b.take(2, 3, now+500) {
+		t.Error("Bucket must refill a token in 500ms at rate 2")
+	}
+	if b.take(2, 3, now+500) {
+		t.Error("Refilled token must be taken only once")
+	}
+
+	// Long idle refills up to burst only
+	now += 3600 * 1000
+	for i := 0; i < 3; i++ {
+		if !b.take(2, 3, now) {
+			t.Fatalf("Token %v of refilled bucket must be taken", i)
+		}
+	}
+	if b.take(2, 3, now) {
+		t.Error("Refill must be capped at burst")
+	}
+}
+
+func newRateLimitServer(penalty string) *PolicyServer {
+	s := &PolicyServer{
+		stats:       make(map[string]*Stats),
+		banChannel:  make(chan *storage.Ban, 8),
+		whitelist:   util.NewIPTrie(),
+		ipBlacklist: util.NewIPTrie(),
+		startedAt:   util.MakeTimestamp() - 1000,
+	}
+	s.config.Store(&Config{
+		Banning: Banning{Enabled: true, Timeout: 60, MalformedLimit: 100},
+		RateLimits: RateLimits{
+			Enabled:     true,
+			Connections: Bucket{Rate: 0.001, Burst: 1, Penalty: penalty},
+		},
+	})
+	return s
+}
+
+func TestRateLimitPenalty(t *testing.T) {
+	const ip = "192.0.2.1"
+	for _, penalty := range []string{"", penaltyReject, penaltyMalformed, penaltyBan} {
+		s := newRateLimitServer(penalty)
+		if !s.AllowConnection(ip) {
+			t.Fatalf("%q: first connection must be allowed", penalty)
+		}
+		if s.AllowConnection(ip) {
+			t.Errorf("%q: connection over burst must be refused", penalty)
+		}
+		x := s.Get(ip)
+		malformed := atomic.LoadInt32(&x.Malformed)
+		banned := atomic.LoadInt32(&x.Banned)
+
+		switch penalty {
+		case "", penaltyReject:
+			if malformed != 0 || banned != 0 {
+				t.Errorf("%q: refusal must not be penalized, malformed %v, banned %v", penalty, malformed, banned)
+			}
+		case penaltyMalformed:
+			if malformed != 1 || banned != 0 {
+				t.Errorf("%q: refusal must count as malformed request, malformed %v, banned %v", penalty, malformed, banned)
+			}
+		case penaltyBan:
+			if banned != 1 {
+				t.Errorf("%q: refusal must ban", penalty)
+			}
+			select {
+			case ban := <-s.banChannel:
+				if ban.IP != ip || ban.Reason != banConnRate {
+					t.Errorf("%q: unexpected ban %+v", penalty, ban)
+				}
+			default:
+				t.Errorf("%q: ban must be shared", penalty)
+			}
+		}
+	}
+}
+
+func TestRateLimitExemptions(t *testing.T) {
+	const ip = "192.0.2.1"
+
+	s := newRateLimitServer(penaltyBan)
+	s.whitelist.Insert(ip)
+	for i := 0; i < 3; i++ {
+		if !s.AllowConnection(ip) {
+			t.Fatal("Whitelisted address must not be limited")
+		}
+	}
+
+	// Connection limit grace also delays rate limiting
+	s = newRateLimitServer(penaltyBan)
+	atomic.StoreInt64(&s.grace, 60000)
+	for i := 0; i < 3; i++ {
+		if !s.AllowConnection(ip) {
+			t.Fatal("Connections within grace must not be limited")
+		}
+	}
+
+	s = newRateLimitServer(penaltyBan)
+	s.cfg().RateLimits.Connections.Rate = 0
+	for i := 0; i < 3; i++ {
+		if !s.AllowConnection(ip) {
+			t.Fatal("Zero rate must disable limit")
+		}
+	}
+
+	s = newRateLimitServer(penaltyBan)
+	s.cfg().RateLimits.Enabled = false
+	for i := 0; i < 3; i++ {
+		if !s.AllowConnection(ip) {
+			t.Fatal("Disabled rate limits must not limit")
+		}
+	}
+}
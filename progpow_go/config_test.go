@@ -0,0 +1,39 @@
+package progpow_go
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	var config Config
+	if err := json.Unmarshal([]byte(`{"cacheDir": "caches"}`), &config); err != nil {
+		t.Fatalf("Failed to decode config: %v", err)
+	}
+	expected := DefaultConfig
+	expected.CacheDir = "caches"
+	if config != expected {
+		t.Errorf("Omitted fields must keep defaults, got %+v", config)
+	}
+
+	// Explicit zero values are kept
+	config = Config{}
+	if err := json.Unmarshal([]byte(`{"cacheDir": "", "cachesOnDisk": 0}`), &config); err != nil {
+		t.Fatalf("Failed to decode config: %v", err)
+	}
+	if config.CacheDir != "" || config.CachesOnDisk != 0 || config.CachesInMem != DefaultConfig.CachesInMem {
+		t.Errorf("Configured fields must override defaults, got %+v", config)
+	}
+
+	// Pointer in parent config is decoded the same way
+	var parent struct {
+		ProgPoW *Config `json:"progpow"`
+	}
+	if err := json.Unmarshal([]byte(`{"progpow": {"cachesInMem": 4}}`), &parent); err != nil {
+		t.Fatalf("Failed to decode config: %v", err)
+	}
+	if parent.ProgPoW.CachesInMem != 4 || parent.ProgPoW.CachesOnDisk != DefaultConfig.CachesOnDisk ||
+		parent.ProgPoW.DatasetDir != DefaultConfig.DatasetDir {
+		t.Errorf("Omitted fields must keep defaults, got %+v", parent.ProgPoW)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"runtime"
 
 	"github.com/sero-cash/go-czero-import/seroparam"
+	"github.com/sero-cash/go-sero/common"
 )
 
 // Various error messages to mark blocks invalid. These should be private to
@@ -42,37 +43,69 @@ func (ethash *Ethash) Verify(block Block) bool {
 	if block.Difficulty().Sign() <= 0 {
 		return false
 	}
-	// Recompute the digest and PoW value and verify against the header
-	number := block.NumberU64()
+	result, ok := ethash.Result(block)
+	return ok && CheckDifficulty(result, block.Difficulty())
+}
+
+// Result recomputes the PoW value of the block, so it can be checked against several
+// difficulties at once. Returns false if the mix digest of the block does not match.
+func (ethash *Ethash) Result(block Block) (*big.Int, bool) {
+	digest, result := ethash.Compute(block.NumberU64(), block.HashNoNonce(), block.Nonce())
+
+	md := block.MixDigest()
+	if !bytes.Equal(md[:], digest) {
+		return nil, false
+	}
+	return new(big.Int).SetBytes(result), true
+}
 
+// CheckDifficulty reports whether PoW value meets the target of given difficulty.
+func CheckDifficulty(result, difficulty *big.Int) bool {
+	if difficulty.Sign() <= 0 {
+		return false
+	}
+	target := new(big.Int).Div(maxUint256, difficulty)
+	return result.Cmp(target) <= 0
+}
+
+// Compute runs light verification of the header hash and nonce at the given height,
+// returning the mix digest and the PoW value. ProgPoW is used from SIP3 on, ethash before it.
+func (ethash *Ethash) Compute(number uint64, hash common.Hash, nonce uint64) ([]byte, []byte) {
 	cache := ethash.cache(number)
 	size := datasetSize(number)
 
 	var digest []byte
 	var result []byte
 	if number >= seroparam.SIP3() {
-		digest, result = progpowLightWithoutCDag(size, cache.cache, block.HashNoNonce().Bytes(), block.Nonce(), number)
+		digest, result = progpowLightWithoutCDag(size, cache.cache, hash.Bytes(), nonce, number)
 
 		//dataset := ethash.dataset_async(number)
 		//if dataset.generated() {
-		//	digest, result = progpowFull(dataset.dataset, block.HashNoNonce().Bytes(), block.Nonce(), number)
+		//	digest, result = progpowFull(dataset.dataset, hash.Bytes(), nonce, number)
 		//} else {
-		//	digest, result = progpowLightWithoutCDag(size, cache.cache, block.HashNoNonce().Bytes(), block.Nonce(), number)
+		//	digest, result = progpowLightWithoutCDag(size, cache.cache, hash.Bytes(), nonce, number)
 		//}
 	} else {
-		digest, result = hashimotoLight(size, cache.cache, block.HashNoNonce().Bytes(), block.Nonce(), number)
+		digest, result = hashimotoLight(size, cache.cache, hash.Bytes(), nonce, number)
 	}
 	// Caches are unmapped in a finalizer. Ensure that the cache stays live
 	// until after the call to hashimotoLight so it's not unmapped while being used.
 	runtime.KeepAlive(cache)
+	return digest, result
+}
 
-	md := block.MixDigest()
-	if !bytes.Equal(md[:], digest) {
-		return false
+// Algorithm returns the name of the PoW algorithm used at the given height.
+func Algorithm(number uint64) string {
+	if number >= seroparam.SIP3() {
+		return "progpow"
 	}
-	target := new(big.Int).Div(maxUint256, block.Difficulty())
-	if new(big.Int).SetBytes(result).Cmp(target) > 0 {
-		return false
+	return "ethash"
+}
+
+// ResultDifficulty returns the highest difficulty the PoW value satisfies.
+func ResultDifficulty(result *big.Int) *big.Int {
+	if result.Sign() <= 0 {
+		return new(big.Int).Set(maxUint256)
 	}
-	return true
+	return new(big.Int).Div(maxUint256, result)
 }
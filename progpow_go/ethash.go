@@ -18,6 +18,7 @@
 package progpow_go
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
@@ -27,9 +28,11 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	mmap "github.com/edsrzf/mmap-go"
@@ -193,6 +196,39 @@ func (lru *lru) get(epoch uint64) (item, future interface{}) {
 	return item, future
 }
 
+// peek returns the item of the given epoch if it is either cached or the future item.
+func (lru *lru) peek(epoch uint64) interface{} {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	if item, ok := lru.cache.Peek(epoch); ok {
+		return item
+	}
+	if lru.future > 0 && lru.future == epoch {
+		return lru.futureItem
+	}
+	return nil
+}
+
+// items returns cached items and the future item, ordered by epoch.
+func (lru *lru) items() []interface{} {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	keys := lru.cache.Keys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].(uint64) < keys[j].(uint64) })
+	var items []interface{}
+	for _, key := range keys {
+		if item, ok := lru.cache.Peek(key); ok {
+			items = append(items, item)
+		}
+	}
+	if _, ok := lru.cache.Peek(lru.future); lru.futureItem != nil && !ok {
+		items = append(items, lru.futureItem)
+	}
+	return items
+}
+
 // cache wraps an ethash cache with some metadata to allow easier concurrent use.
 type cache struct {
 	epoch uint64    // Epoch for which this cache is relevant
@@ -200,6 +236,8 @@ type cache struct {
 	mmap  mmap.MMap // Memory map itself to unmap before releasing
 	cache []uint32  // The actual cache data content (may be memory mapped)
 	once  sync.Once // Ensures the cache is generated only once
+	took  time.Duration
+	done  uint32
 }
 
 // newCache creates a new ethash verification cache and returns it as a plain Go
@@ -211,6 +249,11 @@ func newCache(epoch uint64) interface{} {
 // generate ensures that the cache content is generated before use.
 func (c *cache) generate(dir string, limit int) {
 	c.once.Do(func() {
+		start := time.Now()
+		defer func() {
+			c.took = time.Since(start)
+			atomic.StoreUint32(&c.done, 1)
+		}()
 		size := cacheSize(c.epoch*epochLength + 1)
 		seed := seedHash(c.epoch*epochLength + 1)
 		// If we don't store anything on disk, generate and return.
@@ -365,12 +408,34 @@ func (d *dataset) finalizer() {
 
 // Config are the configuration parameters of the ethash.
 type Config struct {
-	CacheDir       string
-	CachesInMem    int
-	CachesOnDisk   int
-	DatasetDir     string
-	DatasetsInMem  int
-	DatasetsOnDisk int
+	CacheDir       string `json:"cacheDir"`
+	CachesInMem    int    `json:"cachesInMem"`
+	CachesOnDisk   int    `json:"cachesOnDisk"`
+	DatasetDir     string `json:"datasetDir"`
+	DatasetsInMem  int    `json:"datasetsInMem"`
+	DatasetsOnDisk int    `json:"datasetsOnDisk"`
+}
+
+// DefaultConfig contains the settings used when none are configured.
+var DefaultConfig = Config{
+	CacheDir:       "ethash",
+	CachesInMem:    2,
+	CachesOnDisk:   3,
+	DatasetDir:     defaultDir(),
+	DatasetsInMem:  1,
+	DatasetsOnDisk: 2,
+}
+
+// UnmarshalJSON applies fields present in JSON on top of DefaultConfig,
+// so setting one of them does not reset the others.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type plain Config
+	config := plain(DefaultConfig)
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	*c = Config(config)
+	return nil
 }
 
 // Ethash is a consensus engine based on proof-of-work implementing the ethash
@@ -391,8 +456,8 @@ type Ethash struct {
 }
 
 // New creates a full sized ethash PoW scheme.
-func New() *Ethash {
-	/*if config.CachesInMem <= 0 {
+func New(config Config) *Ethash {
+	if config.CachesInMem <= 0 {
 		log.Warn("One ethash cache must always be in memory", "requested", config.CachesInMem)
 		config.CachesInMem = 1
 	}
@@ -401,14 +466,6 @@ func New() *Ethash {
 	}
 	if config.DatasetDir != "" && config.DatasetsOnDisk > 0 {
 		log.Info("Disk storage enabled for ethash DAGs", "dir", config.DatasetDir, "count", config.DatasetsOnDisk)
-	}*/
-	config := Config{
-		CacheDir:       "ethash",
-		CachesInMem:    2,
-		CachesOnDisk:   3,
-		DatasetDir:     defaultDir(),
-		DatasetsInMem:  1,
-		DatasetsOnDisk: 2,
 	}
 
 	return &Ethash{
@@ -439,6 +496,57 @@ func (ethash *Ethash) cache(block uint64) *cache {
 	return current
 }
 
+// CacheStatus describes the verification cache of a single epoch.
+type CacheStatus struct {
+	Epoch     uint64
+	Generated bool
+	Took      time.Duration // Time spent generating or loading the cache
+}
+
+func (c *cache) status() CacheStatus {
+	status := CacheStatus{Epoch: c.epoch}
+	if atomic.LoadUint32(&c.done) == 1 {
+		status.Generated = true
+		status.Took = c.took
+	}
+	return status
+}
+
+// Epoch returns the epoch the given block number belongs to.
+func Epoch(block uint64) uint64 {
+	return block / epochLength
+}
+
+// Warm generates the verification caches of the epoch of the given block and of
+// the next one, so the shares following a start or an epoch switch are not held up.
+func (ethash *Ethash) Warm(block uint64) (current, next CacheStatus) {
+	epoch := block / epochLength
+	currentI, futureI := ethash.caches.get(epoch)
+	c := currentI.(*cache)
+	c.generate(ethash.config.CacheDir, ethash.config.CachesOnDisk)
+	current = c.status()
+
+	if futureI == nil {
+		futureI = ethash.caches.peek(epoch + 1)
+	}
+	if futureI != nil {
+		f := futureI.(*cache)
+		f.generate(ethash.config.CacheDir, ethash.config.CachesOnDisk)
+		next = f.status()
+	}
+	return current, next
+}
+
+// Caches reports the state of verification caches held in memory, ordered by epoch.
+func (ethash *Ethash) Caches() []CacheStatus {
+	items := ethash.caches.items()
+	result := make([]CacheStatus, 0, len(items))
+	for _, item := range items {
+		result = append(result, item.(*cache).status())
+	}
+	return result
+}
+
 func (ethash *Ethash) dataset_async(block uint64) *dataset {
 	// Retrieve the requested ethash dataset
 	epoch := block / epochLength
@@ -0,0 +1,121 @@
+package progpow_go
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/sero-cash/go-czero-import/seroparam"
+	"github.com/sero-cash/go-sero/common"
+)
+
+// Vector is a known-good PoW submission, such as a block accepted by the network.
+type Vector struct {
+	Height     uint64 `json:"height"`
+	HeaderHash string `json:"headerHash"`
+	Nonce      string `json:"nonce"`
+	MixDigest  string `json:"mixDigest"`
+	// PoW value, checked only if set
+	Result string `json:"result"`
+}
+
+// Arbitrary work checked on both sides of the fork
+var (
+	selfTestHash  = common.HexToHash("0x5d1a8a4c0e3a1f7b9c2e6d8f0a4b3c5d7e9f1a2b4c6d8e0f1a3b5c7d9e1f2a3b")
+	selfTestNonce = uint64(0x1f2e3d4c5b6a7988)
+)
+
+// vectorBlock adapts a submission to Block
+type vectorBlock struct {
+	number uint64
+	hash   common.Hash
+	nonce  uint64
+	mix    common.Hash
+}
+
+func (b *vectorBlock) Difficulty() *big.Int     { return big.NewInt(1) }
+func (b *vectorBlock) HashNoNonce() common.Hash { return b.hash }
+func (b *vectorBlock) Nonce() uint64            { return b.nonce }
+func (b *vectorBlock) MixDigest() common.Hash   { return b.mix }
+func (b *vectorBlock) NumberU64() uint64        { return b.number }
+
+// ParseNonce accepts a nonce in hex with or without 0x prefix.
+func ParseNonce(nonce string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(nonce, "0x"), 16, 64)
+}
+
+// SelfTest checks that verification switches from ethash to ProgPoW exactly at SIP3
+// and accepts its own output on both sides of the fork, then checks MainnetVectors and the given vectors.
+// Only known-good vectors catch a wrong implementation, so they must cover both sides of the fork.
+func (ethash *Ethash) SelfTest(vectors []Vector) error {
+	fork := seroparam.SIP3()
+	vectors = append(append([]Vector(nil), MainnetVectors...), vectors...)
+	var below, above bool
+	for _, v := range vectors {
+		below = below || v.Height < fork
+		above = above || v.Height >= fork
+	}
+	if !below || !above {
+		return fmt.Errorf("known-good vectors must cover both sides of SIP3 at height %d", fork)
+	}
+	heights := []uint64{fork}
+	if fork > 0 {
+		heights = []uint64{fork - 1, fork}
+	}
+	for _, number := range heights {
+		digest, result := ethash.Compute(number, selfTestHash, selfTestNonce)
+		again, _ := ethash.Compute(number, selfTestHash, selfTestNonce)
+		if !bytes.Equal(digest, again) {
+			return fmt.Errorf("%s at height %d is not deterministic", Algorithm(number), number)
+		}
+
+		// The other algorithm must not be the one in use
+		cache := ethash.cache(number)
+		size := datasetSize(number)
+		var other []byte
+		if number >= fork {
+			other, _ = hashimotoLight(size, cache.cache, selfTestHash.Bytes(), selfTestNonce, number)
+		} else {
+			other, _ = progpowLightWithoutCDag(size, cache.cache, selfTestHash.Bytes(), selfTestNonce, number)
+		}
+		runtime.KeepAlive(cache)
+		if bytes.Equal(digest, other) {
+			return fmt.Errorf("ethash and progpow agree at height %d", number)
+		}
+
+		block := &vectorBlock{number: number, hash: selfTestHash, nonce: selfTestNonce, mix: common.BytesToHash(digest)}
+		value, ok := ethash.Result(block)
+		if !ok || value.Cmp(new(big.Int).SetBytes(result)) != 0 {
+			return fmt.Errorf("%s rejects its own mix at height %d", Algorithm(number), number)
+		}
+		block.mix[0] ^= 0xff
+		if _, ok := ethash.Result(block); ok {
+			return fmt.Errorf("%s accepts tampered mix at height %d", Algorithm(number), number)
+		}
+	}
+
+	return ethash.checkVectors(vectors)
+}
+
+// checkVectors recomputes every vector and compares it with the expected mix digest and result.
+func (ethash *Ethash) checkVectors(vectors []Vector) error {
+	for i, v := range vectors {
+		nonce, err := ParseNonce(v.Nonce)
+		if err != nil {
+			return fmt.Errorf("vector %d: invalid nonce %q", i, v.Nonce)
+		}
+		digest, result := ethash.Compute(v.Height, common.HexToHash(v.HeaderHash), nonce)
+		if mix := common.HexToHash(v.MixDigest); !bytes.Equal(mix[:], digest) {
+			return fmt.Errorf("vector %d at height %d: mix %x, expected %s", i, v.Height, digest, v.MixDigest)
+		}
+		if len(v.Result) > 0 {
+			if expected := common.HexToHash(v.Result); !bytes.Equal(expected[:], result) {
+				return fmt.Errorf("vector %d at height %d: result %x, expected %s", i, v.Height, result, v.Result)
+			}
+		}
+	}
+	return nil
+}
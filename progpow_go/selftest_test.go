@@ -0,0 +1,36 @@
+package progpow_go
+
+import (
+	"testing"
+
+	"github.com/sero-cash/go-czero-import/seroparam"
+)
+
+func TestMainnetVectors(t *testing.T) {
+	fork := seroparam.SIP3()
+	var below, above bool
+	for _, v := range MainnetVectors {
+		below = below || v.Height < fork
+		above = above || v.Height >= fork
+	}
+	if !below || !above {
+		t.Fatalf("MainnetVectors must hold blocks on both sides of SIP3 at height %d, e.g. %d and %d", fork, fork-1, fork)
+	}
+	hasher := New(Config{CachesInMem: 2})
+	if err := hasher.checkVectors(MainnetVectors); err != nil {
+		t.Error(err)
+	}
+	if err := hasher.SelfTest(nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSelfTestRequiresVectors(t *testing.T) {
+	if len(MainnetVectors) > 0 {
+		t.Skip("Mainnet vectors are embedded")
+	}
+	below := Vector{Height: seroparam.SIP3() - 1}
+	if err := New(Config{CachesInMem: 1}).SelfTest([]Vector{below}); err == nil {
+		t.Error("Self-test must fail without vectors at SIP3")
+	}
+}
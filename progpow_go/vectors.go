@@ -0,0 +1,9 @@
+package progpow_go
+
+// MainnetVectors are blocks accepted by SERO mainnet right below and at SIP3 height 130000,
+// SelfTest and package tests check them on every run. Header hash is the seal hash of the block,
+// header hashed without nonce and mix digest, as given to miners in getWork.
+//
+// Take them from a synced node, blocks 129999 and 130000 at least: seal hash, nonce and mix digest
+// of the block, and its PoW result. TestMainnetVectors fails until they are filled in.
+var MainnetVectors = []Vector{}
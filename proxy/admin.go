@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/yvasiyarov/go-metrics"
+
+	"github.com/sero-cash/mine-pool/util"
+)
+
+// Serves instance internals, must not be exposed to miners
+func (s *ProxyServer) ListenAdmin() {
+	log.Printf("Starting proxy admin on %v", s.config.Proxy.Admin.Listen)
+	r := mux.NewRouter()
+	r.HandleFunc("/metrics", s.MetricsIndex)
+	r.HandleFunc("/health", s.HealthIndex)
+	r.HandleFunc("/sessions", s.SessionsIndex).Methods("GET")
+	r.HandleFunc("/sessions/kick", s.KickSessions).Methods("POST")
+	err := http.ListenAndServe(s.config.Proxy.Admin.Listen, r)
+	if err != nil {
+		log.Fatalf("Failed to start proxy admin: %v", err)
+	}
+}
+
+func (s *ProxyServer) MetricsIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	metrics.WriteJSONOnce(metrics.DefaultRegistry, w)
+}
+
+// Healthy when upstream is not failing and shares of current epoch can be verified without delay
+func (s *ProxyServer) HealthIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ready, caches := s.cachesStatus()
+	sick := s.isSick()
+	reply := map[string]interface{}{
+		"healthy":     ready && !sick,
+		"sick":        sick,
+		"epoch":       atomic.LoadInt64(&s.epoch),
+		"cacheReady":  ready,
+		"caches":      caches,
+		"verifyQueue": s.verifier.depth.Value(),
+	}
+	if t := s.currentBlockTemplate(); t != nil {
+		reply["height"] = t.Height
+	}
+	if ready && !sick {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+func (cs *Session) countShare(exist, validShare, stale bool) {
+	if exist {
+		atomic.AddInt64(&cs.duplicateShares, 1)
+		return
+	}
+	if stale {
+		atomic.AddInt64(&cs.staleShares, 1)
+	} else if validShare {
+		atomic.AddInt64(&cs.validShares, 1)
+		atomic.StoreInt64(&cs.lastShare, util.MakeTimestamp())
+	} else {
+		atomic.AddInt64(&cs.invalidShares, 1)
+	}
+}
+
+func (cs *Session) info(difficulty int64) map[string]interface{} {
+	cs.identMu.RLock()
+	defer cs.identMu.RUnlock()
+	return map[string]interface{}{
+		"id":          cs.id,
+		"login":       cs.login,
+		"worker":      cs.worker,
+		"ip":          cs.ip,
+		"agent":       cs.agent,
+		"connectedAt": cs.connectedAt,
+		"lastShare":   atomic.LoadInt64(&cs.lastShare),
+		"valid":       atomic.LoadInt64(&cs.validShares),
+		"stale":       atomic.LoadInt64(&cs.staleShares),
+		"invalid":     atomic.LoadInt64(&cs.invalidShares),
+		"duplicate":   atomic.LoadInt64(&cs.duplicateShares),
+		"difficulty":  difficulty,
+	}
+}
+
+// Returns logged in sessions matching all of given filters
+func (s *ProxyServer) findSessions(r *http.Request) []*Session {
+	login := r.FormValue("login")
+	worker := r.FormValue("worker")
+	ip := r.FormValue("ip")
+	id, _ := strconv.ParseUint(r.FormValue("id"), 10, 64)
+
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	result := make([]*Session, 0)
+	for cs := range s.sessions {
+		csLogin, csWorker := cs.identity()
+		if (len(login) > 0 && csLogin != login) || (len(worker) > 0 && csWorker != worker) ||
+			(len(ip) > 0 && cs.ip != ip) || (id > 0 && cs.id != id) {
+			continue
+		}
+		result = append(result, cs)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+	return result
+}
+
+// Lists stratum and websocket sessions, filtered by login, worker, ip or id
+func (s *ProxyServer) SessionsIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	difficulty := s.currentDiff().difficulty
+	sessions := s.findSessions(r)
+	list := make([]map[string]interface{}, len(sessions))
+	for i, cs := range sessions {
+		list[i] = cs.info(difficulty)
+	}
+	reply := make(map[string]interface{})
+	reply["sessions"] = list
+	reply["total"] = len(list)
+
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+// Checks bearer token if configured, otherwise request must come from loopback address
+func (s *ProxyServer) isAdminAuthorized(r *http.Request) bool {
+	token := s.config.Proxy.Admin.Token
+	if len(token) > 0 {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Disconnects session by id or all sessions of login
+func (s *ProxyServer) KickSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if !s.isAdminAuthorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if len(r.FormValue("id")) == 0 && len(r.FormValue("login")) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	sessions := s.findSessions(r)
+	for _, cs := range sessions {
+		login, _ := cs.identity()
+		log.Printf("Kicking session %v of %v@%v", cs.id, login, cs.ip)
+		cs.conn.Close()
+	}
+	reply := make(map[string]interface{})
+	reply["kicked"] = len(sessions)
+
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
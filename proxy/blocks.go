@@ -48,6 +48,10 @@ func (b Block) MixDigest() common.Hash   { return b.mixDigest }
 func (b Block) NumberU64() uint64        { return b.number }
 
 func (s *ProxyServer) fetchBlockTemplate() {
+	if s.pool != nil {
+		s.fetchPoolTemplate()
+		return
+	}
 	rpc := s.rpc()
 	t := s.currentBlockTemplate()
 	pendingReply, height, diff, err := s.fetchPendingBlock()
@@ -64,8 +68,30 @@ func (s *ProxyServer) fetchBlockTemplate() {
 	if t != nil && t.Header == reply[0] {
 		return
 	}
+	s.storeTemplate(rpc.Name, reply, height, diff, pendingReply)
+}
+
+// Farm mode, takes the last job pushed by upstream pool. Its target is the upstream share target,
+// so solutions meeting it are treated as blocks and forwarded to the pool.
+func (s *ProxyServer) fetchPoolTemplate() {
+	t := s.currentBlockTemplate()
+	reply := s.pool.Job()
+	if reply == nil || (t != nil && t.Header == reply[0]) {
+		return
+	}
+	height, err := strconv.ParseUint(reply[3], 10, 64)
+	if err != nil {
+		log.Printf("Can't parse job height from %s: %v", s.pool.Name, err)
+		return
+	}
+	diff := util.TargetHexToDiff(reply[2]).Int64()
+	pendingReply := &rpc.GetBlockReplyPart{Number: util.ToHex(int64(height))}
+	s.storeTemplate(s.pool.Name, reply, height, diff, pendingReply)
+}
 
-	pendingReply.Difficulty = util.ToHex(s.config.Proxy.Difficulty)
+func (s *ProxyServer) storeTemplate(name string, reply []string, height uint64, diff int64, pendingReply *rpc.GetBlockReplyPart) {
+	t := s.currentBlockTemplate()
+	pendingReply.Difficulty = util.ToHex(s.currentDiff().difficulty)
 
 	newTemplate := BlockTemplate{
 		Header:               reply[0],
@@ -89,10 +115,12 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		}
 	}
 	s.blockTemplate.Store(&newTemplate)
-	log.Printf("New block to mine on %s at height %d / %s", rpc.Name, height, reply[0][0:10])
+	log.Printf("New block to mine on %s at height %d / %s", name, height, reply[0][0:10])
+	s.updateEpoch(height)
+	s.signalNewWork()
 
 	// Stratum
-	if s.config.Proxy.Stratum.Enabled {
+	if s.config.Proxy.Stratum.Enabled || s.config.Proxy.WebSocket.Enabled {
 		go s.broadcastNewJobs()
 	}
 }
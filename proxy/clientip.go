@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolves address of miner. Behind reverse proxy forwarding headers are walked right to left,
+// skipping trusted proxies, so hops prepended by client itself are never taken into account.
+// Headers are ignored unless the direct peer is a trusted proxy.
+func (s *ProxyServer) remoteAddr(r *http.Request) string {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !s.config.Proxy.BehindReverseProxy {
+		return ip
+	}
+	peer := net.ParseIP(ip)
+	if peer == nil || !s.isTrustedProxy(peer) {
+		return ip
+	}
+	hops := forwardedChain(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHopIP(hops[i])
+		// Obfuscated or unknown hop, nothing behind it can be verified
+		if hop == nil {
+			break
+		}
+		ip = hop.String()
+		if !s.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (s *ProxyServer) isTrustedProxy(ip net.IP) bool {
+	for _, n := range s.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns client chain from the most detailed header present, nearest hop last.
+func forwardedChain(r *http.Request) []string {
+	if values := r.Header["Forwarded"]; len(values) > 0 {
+		var hops []string
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			hops = append(hops, forwardedFor(element))
+		}
+		return hops
+	}
+	if values := r.Header["X-Forwarded-For"]; len(values) > 0 {
+		return strings.Split(strings.Join(values, ","), ",")
+	}
+	if ip := r.Header.Get("X-Real-Ip"); len(ip) > 0 {
+		return []string{ip}
+	}
+	return nil
+}
+
+// Extracts "for" parameter of RFC 7239 forwarded-element, e.g. for="[2001:db8::1]:4711";proto=http
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+			return kv[1]
+		}
+	}
+	return ""
+}
+
+// Accepts bare address, address with port and bracketed IPv6, optionally quoted.
+func parseHopIP(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), "\"")
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if strings.HasPrefix(hop, "[") {
+		if end := strings.Index(hop, "]"); end > 0 {
+			return net.ParseIP(hop[1:end])
+		}
+		return nil
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
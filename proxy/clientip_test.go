@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func newClientIPServer(t *testing.T, behind bool, trusted ...string) *ProxyServer {
+	nets, err := parseTrustedNets(trusted)
+	if err != nil {
+		t.Fatalf("Invalid trusted proxies %v: %v", trusted, err)
+	}
+	s := &ProxyServer{config: &Config{}, trustedProxies: nets}
+	s.config.Proxy.BehindReverseProxy = behind
+	return s
+}
+
+func TestRemoteAddr(t *testing.T) {
+	trusted := newClientIPServer(t, true, "10.0.0.0/8", "2001:db8:ffff::/48")
+	untrusted := newClientIPServer(t, true)
+	direct := newClientIPServer(t, false, "10.0.0.0/8")
+
+	tests := []struct {
+		name   string
+		s      *ProxyServer
+		peer   string
+		header map[string][]string
+		ip     string
+	}{
+		{"not behind proxy", direct, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"192.0.2.1"}}, "10.0.0.1"},
+		{"no headers", trusted, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"xff single hop", trusted, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"192.0.2.1"}}, "192.0.2.1"},
+		// Client prepends fake entries, only hops added by trusted proxies count
+		{"xff spoofed left-most", trusted, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"1.1.1.1, 192.0.2.1"}}, "192.0.2.1"},
+		{"xff spoofed trusted left-most", trusted, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"10.9.9.9, 192.0.2.1, 10.0.0.2"}}, "192.0.2.1"},
+		{"xff repeated headers", trusted, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"1.1.1.1", "192.0.2.1, 10.0.0.2"}}, "192.0.2.1"},
+		{"xff all trusted", trusted, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"xff garbage hop", trusted, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"192.0.2.1, unknown, 10.0.0.2"}}, "10.0.0.2"},
+		// Headers of peer which is not trusted proxy are ignored
+		{"untrusted peer", trusted, "192.0.2.9:1234", map[string][]string{"X-Forwarded-For": {"192.0.2.1"}}, "192.0.2.9"},
+		{"untrusted peer forwarded", trusted, "192.0.2.9:1234", map[string][]string{"Forwarded": {"for=192.0.2.1"}}, "192.0.2.9"},
+		// Without trusted list no peer may forward address
+		{"empty trusted list", untrusted, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"1.1.1.1, 192.0.2.1"}}, "10.0.0.1"},
+		{"empty trusted list forwarded", untrusted, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=1.1.1.1, for=192.0.2.1"}}, "10.0.0.1"},
+		{"empty trusted list x-real-ip", untrusted, "10.0.0.1:1234", map[string][]string{"X-Real-Ip": {"192.0.2.1"}}, "10.0.0.1"},
+		{"forwarded", trusted, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=192.0.2.1;proto=http;by=10.0.0.1"}}, "192.0.2.1"},
+		{"forwarded spoofed left-most", trusted, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=1.1.1.1, for=192.0.2.1", "for=10.0.0.2"}}, "192.0.2.1"},
+		{"forwarded case insensitive", trusted, "10.0.0.1:1234", map[string][]string{"Forwarded": {"proto=https; For=192.0.2.1"}}, "192.0.2.1"},
+		{"forwarded obfuscated hop", trusted, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=192.0.2.1, for=_hidden, for=10.0.0.2"}}, "10.0.0.2"},
+		{"forwarded unknown", trusted, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=unknown"}}, "10.0.0.1"},
+		{"forwarded preferred over xff", trusted, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=192.0.2.1"}, "X-Forwarded-For": {"192.0.2.2"}}, "192.0.2.1"},
+		{"forwarded with port", trusted, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=\"192.0.2.1:4711\""}}, "192.0.2.1"},
+		{"forwarded ipv6 bracketed", trusted, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=\"[2001:db8::1]\""}}, "2001:db8::1"},
+		{"forwarded ipv6 with port", trusted, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=\"[2001:db8::1]:4711\""}}, "2001:db8::1"},
+		{"xff ipv6 bare", trusted, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"2001:db8::1"}}, "2001:db8::1"},
+		{"xff ipv6 with port", trusted, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"[2001:db8::1]:4711"}}, "2001:db8::1"},
+		{"xff ipv6 unterminated bracket", trusted, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"[2001:db8::1"}}, "10.0.0.1"},
+		{"ipv6 trusted peer", trusted, "[2001:db8:ffff::1]:1234", map[string][]string{"X-Forwarded-For": {"2001:db8::1"}}, "2001:db8::1"},
+		{"ipv6 untrusted peer", trusted, "[2001:db8::2]:1234", map[string][]string{"X-Forwarded-For": {"192.0.2.1"}}, "2001:db8::2"},
+		{"xff ipv4 with port", trusted, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"192.0.2.1:4711"}}, "192.0.2.1"},
+		{"x-real-ip", trusted, "10.0.0.1:1234", map[string][]string{"X-Real-Ip": {"192.0.2.1"}}, "192.0.2.1"},
+	}
+	for _, test := range tests {
+		r := &http.Request{RemoteAddr: test.peer, Header: http.Header(test.header)}
+		if ip := test.s.remoteAddr(r); ip != test.ip {
+			t.Errorf("%s: expected %v, got %v", test.name, test.ip, ip)
+		}
+	}
+}
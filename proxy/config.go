@@ -2,8 +2,10 @@ package proxy
 
 import (
 	"github.com/sero-cash/mine-pool/api"
+	"github.com/sero-cash/mine-pool/archive"
 	"github.com/sero-cash/mine-pool/payouts"
 	"github.com/sero-cash/mine-pool/policy"
+	"github.com/sero-cash/mine-pool/progpow_go"
 	"github.com/sero-cash/mine-pool/storage"
 )
 
@@ -15,12 +17,16 @@ type Config struct {
 	UpstreamCheckInterval string        `json:"upstreamCheckInterval"`
 
 	Threads int `json:"threads"`
+	// Time to wait for shares being processed on SIGTERM
+	ShutdownTimeout string `json:"shutdownTimeout"`
 
-	Coin  string         `json:"coin"`
-	Redis storage.Config `json:"redis"`
+	Coin     string                 `json:"coin"`
+	Redis    storage.Config         `json:"redis"`
+	Postgres storage.PostgresConfig `json:"postgres"`
 
 	BlockUnlocker payouts.UnlockerConfig `json:"unlocker"`
 	Payouts       payouts.PayoutsConfig  `json:"payouts"`
+	Archiver      archive.ArchiverConfig `json:"archiver"`
 
 	NewrelicName    string `json:"newrelicName"`
 	NewrelicKey     string `json:"newrelicKey"`
@@ -29,22 +35,36 @@ type Config struct {
 }
 
 type Proxy struct {
-	Enabled              bool   `json:"enabled"`
-	Listen               string `json:"listen"`
-	LimitHeadersSize     int    `json:"limitHeadersSize"`
-	LimitBodySize        int64  `json:"limitBodySize"`
-	BehindReverseProxy   bool   `json:"behindReverseProxy"`
-	BlockRefreshInterval string `json:"blockRefreshInterval"`
-	Difficulty           int64  `json:"difficulty"`
-	StateUpdateInterval  string `json:"stateUpdateInterval"`
-	HashrateExpiration   string `json:"hashrateExpiration"`
+	Enabled            bool   `json:"enabled"`
+	Listen             string `json:"listen"`
+	LimitHeadersSize   int    `json:"limitHeadersSize"`
+	LimitBodySize      int64  `json:"limitBodySize"`
+	BehindReverseProxy bool   `json:"behindReverseProxy"`
+	// Addresses or CIDRs of reverse proxies allowed to set forwarding headers
+	TrustedProxies       []string `json:"trustedProxies"`
+	BlockRefreshInterval string   `json:"blockRefreshInterval"`
+	Difficulty           int64    `json:"difficulty"`
+	StateUpdateInterval  string   `json:"stateUpdateInterval"`
+	HashrateExpiration   string   `json:"hashrateExpiration"`
+	// Keep hashrate reported by mining software for this long, empty disables storing it
+	ReportedHashrateExpiration string `json:"reportedHashrateExpiration"`
 
 	Policy policy.Config `json:"policy"`
 
 	MaxFails    int64 `json:"maxFails"`
 	HealthCheck bool  `json:"healthCheck"`
 
-	Stratum Stratum `json:"stratum"`
+	Stratum     Stratum     `json:"stratum"`
+	WebSocket   WebSocket   `json:"websocket"`
+	ShareBatch  ShareBatch  `json:"shareBatch"`
+	ShareVerify ShareVerify `json:"shareVerify"`
+	BlockSubmit BlockSubmit `json:"blockSubmit"`
+	LongPoll    LongPoll    `json:"longPoll"`
+	Admin       Admin       `json:"admin"`
+
+	ProxyProtocol ProxyProtocol `json:"proxyProtocol"`
+	// Verification cache storage, defaults are used if omitted
+	ProgPoW *progpow_go.Config `json:"progpow"`
 }
 
 type Stratum struct {
@@ -54,8 +74,69 @@ type Stratum struct {
 	MaxConn int    `json:"maxConn"`
 }
 
+type WebSocket struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen"`
+	Timeout string `json:"timeout"`
+	MaxConn int    `json:"maxConn"`
+}
+
+type ShareBatch struct {
+	Enabled    bool   `json:"enabled"`
+	Interval   string `json:"interval"`
+	MaxPending int    `json:"maxPending"`
+}
+
+type ShareVerify struct {
+	// Number of PoW computations run at once, defaults to number of CPUs
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queueSize"`
+	// Shares of a single miner allowed to wait in queue, 0 is unlimited
+	MaxPerSession int `json:"maxPerSession"`
+	// What to do with new share when queue is full: "wait" for room (default), "reject" it
+	// or "shed" the oldest queued one, the latter two may lose a block solution
+	Overload string `json:"overload"`
+}
+
+type BlockSubmit struct {
+	// Number of resubmissions after failed attempt, 0 disables retries
+	Retries int    `json:"retries"`
+	Backoff string `json:"backoff"`
+	// Optional URL to POST failed block alerts to
+	AlertUrl string `json:"alertUrl"`
+}
+
+type LongPoll struct {
+	Enabled   bool   `json:"enabled"`
+	Timeout   string `json:"timeout"`
+	MaxParked int    `json:"maxParked"`
+}
+
+type ProxyProtocol struct {
+	// Listeners that expect PROXY protocol header from load balancer
+	Http      bool `json:"http"`
+	Stratum   bool `json:"stratum"`
+	WebSocket bool `json:"websocket"`
+	// Balancer addresses or CIDRs, header is required from them and ignored from anyone else
+	Trusted []string `json:"trusted"`
+	Timeout string   `json:"timeout"`
+}
+
+type Admin struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen"`
+	// Bearer token required by kick, without it only loopback clients may kick sessions
+	Token string `json:"token"`
+}
+
 type Upstream struct {
-	Name    string `json:"name"`
+	Name string `json:"name"`
+	// Node RPC by default, "pool" chains this instance to a stratum pool at host:port in url
+	Type    string `json:"type"`
 	Url     string `json:"url"`
+	Ws      string `json:"ws"`
 	Timeout string `json:"timeout"`
+	// Pool only, account and worker name to mine with on upstream pool
+	Login  string `json:"login"`
+	Worker string `json:"worker"`
 }
@@ -4,11 +4,35 @@ import (
 	"log"
 	"regexp"
 	"strconv"
+	"strings"
 
+	"github.com/sero-cash/mine-pool/policy"
 	"github.com/sero-cash/mine-pool/rpc"
+	"github.com/sero-cash/mine-pool/storage"
 	"github.com/sero-cash/mine-pool/util"
 )
 
+// Share for a job which is no longer in backlog, miner stays connected
+var errStaleShare = &ErrorReply{Code: 21, Message: "Stale share"}
+
+// Share was not verified because of overload, miner stays connected
+var errServerBusy = &ErrorReply{Code: 20, Message: "Server busy"}
+
+// Request exceeded rate limit, miner stays connected unless penalty banned it
+var errRateLimited = &ErrorReply{Code: 24, Message: "Rate limit exceeded"}
+
+var errLoginSuspended = &ErrorReply{Code: -1, Message: "Login is suspended"}
+
+var errLoginBlacklisted = &ErrorReply{Code: -1, Message: "You are blacklisted"}
+
+// Maps login refused by policy to reply for miner
+func loginPolicyError(err error) *ErrorReply {
+	if err == policy.ErrLoginSuspended {
+		return errLoginSuspended
+	}
+	return errLoginBlacklisted
+}
+
 // Allow only lowercase hexadecimal with 0x prefix
 var noncePattern = regexp.MustCompile("^0x[0-9a-f]{16}$")
 var hashPattern = regexp.MustCompile("^0x[0-9a-f]{64}$")
@@ -24,10 +48,24 @@ func (s *ProxyServer) handleLoginRPC(cs *Session, params []string, id string) (b
 	if !util.IsValidBase58Address(login) {
 		return false, &ErrorReply{Code: -1, Message: "Invalid login"}
 	}
-	if !s.policy.ApplyLoginPolicy(login, cs.ip) {
-		return false, &ErrorReply{Code: -1, Message: "You are blacklisted"}
+	if err := s.policy.ApplyLoginPolicy(login, cs.ip); err != nil {
+		return false, loginPolicyError(err)
 	}
-	cs.login = login
+	if !workerPattern.MatchString(id) {
+		id = "0"
+	}
+	prevLogin, _ := cs.identity()
+	if login != prevLogin {
+		if !s.policy.AcquireWorker(login) {
+			log.Printf("Too many workers of %v, refused %v@%v", login, id, cs.ip)
+			return false, &ErrorReply{Code: -1, Message: "Too many workers"}
+		}
+		// Session switched to another login
+		if len(prevLogin) > 0 {
+			s.policy.ReleaseWorker(prevLogin)
+		}
+	}
+	cs.setIdentity(login, id)
 	s.registerSession(cs)
 	log.Printf("Stratum miner connected %v@%v with %v", login, cs.ip, id)
 	return true, nil
@@ -38,7 +76,7 @@ func (s *ProxyServer) handleGetWorkRPC(cs *Session) ([]string, *ErrorReply) {
 	if t == nil || len(t.Header) == 0 || s.isSick() {
 		return nil, &ErrorReply{Code: 0, Message: "Work not ready"}
 	}
-	return []string{t.Header, t.Seed, s.diff, strconv.FormatUint(t.Height, 10)}, nil
+	return []string{t.Header, t.Seed, s.currentDiff().target, strconv.FormatUint(t.Height, 10)}, nil
 }
 
 // Stratum
@@ -50,35 +88,63 @@ func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, id string, params []string
 	if !ok {
 		return false, &ErrorReply{Code: 25, Message: "Not subscribed"}
 	}
-	return s.handleSubmitRPC(cs, cs.login, id, params)
+	login, _ := cs.identity()
+	return s.handleSubmitRPC(cs, login, id, params)
 }
 
 func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []string) (bool, *ErrorReply) {
 	if !workerPattern.MatchString(id) {
 		id = "0"
 	}
+	if s.policy.IsSuspended(login) {
+		return false, errLoginSuspended
+	}
 	if len(params) != 3 {
 		s.policy.ApplyMalformedPolicy(cs.ip)
+		s.policy.ApplyLoginMalformedPolicy(login)
 		log.Printf("Malformed params from %s@%s %v", login, cs.ip, params)
 		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
 	}
 
 	if !noncePattern.MatchString(params[0]) || !hashPattern.MatchString(params[1]) || !hashPattern.MatchString(params[2]) {
 		s.policy.ApplyMalformedPolicy(cs.ip)
+		s.policy.ApplyLoginMalformedPolicy(login)
 		log.Printf("Malformed PoW result from %s@%s %v", login, cs.ip, params)
 		return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
 	}
 
+	if !s.beginShare() {
+		return false, &ErrorReply{Code: -1, Message: "Server is shutting down"}
+	}
+	defer s.inflight.Done()
+
 	t := s.currentBlockTemplate()
-	exist, validShare := s.processShare(login, id, cs.ip, t, params)
+	exist, validShare, stale, busy := s.processShare(cs, login, id, t, params)
+	// Not the miner's fault, keep it off share policy
+	if busy {
+		return false, errServerBusy
+	}
 
-	ok := s.policy.ApplySharePolicy(cs.ip, !exist && validShare)
+	// Stale shares have their own code and are not counted against the miner
+	ok, loginOk := true, true
+	if !stale {
+		ok = s.policy.ApplySharePolicy(cs.ip, !exist && validShare)
+		loginOk = s.policy.ApplyLoginSharePolicy(login, !exist && validShare)
+	}
+	cs.countShare(exist, validShare, stale)
 
 	if exist {
 		log.Printf("Duplicate share from %s@%s with %v %v", login, cs.ip, id, params)
+		s.writeRejectedShare(login, id, storage.ShareDuplicate)
 		return false, &ErrorReply{Code: 22, Message: "Duplicate share"}
 	}
+	if !loginOk {
+		return validShare, errLoginSuspended
+	}
 
+	if stale {
+		return false, errStaleShare
+	}
 	if !validShare {
 		log.Printf("Invalid share from %s@%s with %v", login, cs.ip, id)
 		// Bad shares limit reached, return error and close
@@ -95,6 +161,31 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
 	return true, nil
 }
 
+// Params are [hashrate, client id] in hex, hashrate is stored only when reporting is enabled.
+func (s *ProxyServer) handleSubmitHashrateRPC(cs *Session, login, id string, params []string) bool {
+	if len(params) == 0 {
+		s.policy.ApplyMalformedPolicy(cs.ip)
+		return false
+	}
+	hashrate, err := strconv.ParseInt(strings.TrimPrefix(params[0], "0x"), 16, 64)
+	if err != nil || hashrate < 0 {
+		s.policy.ApplyMalformedPolicy(cs.ip)
+		log.Printf("Malformed hashrate from %s@%s %v", login, cs.ip, params)
+		return false
+	}
+	if s.reportedExpiration == 0 {
+		return true
+	}
+	if !workerPattern.MatchString(id) {
+		id = "0"
+	}
+	err = s.backend.WriteReportedHashrate(login, id, hashrate, s.reportedExpiration)
+	if err != nil {
+		log.Printf("Failed to store reported hashrate of %s@%s: %v", login, cs.ip, err)
+	}
+	return true
+}
+
 func (s *ProxyServer) handleGetBlockByNumberRPC() *rpc.GetBlockReplyPart {
 	t := s.currentBlockTemplate()
 	var reply *rpc.GetBlockReplyPart
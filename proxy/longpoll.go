@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/yvasiyarov/go-metrics"
+)
+
+// Closed and replaced every time a new block template is stored
+func (s *ProxyServer) newWorkChan() chan struct{} {
+	s.newWorkMu.Lock()
+	defer s.newWorkMu.Unlock()
+	return s.newWork
+}
+
+func (s *ProxyServer) signalNewWork() {
+	s.newWorkMu.Lock()
+	defer s.newWorkMu.Unlock()
+	close(s.newWork)
+	s.newWork = make(chan struct{})
+}
+
+// Long-polling is requested with X-Long-Poll header or longpoll URL parameter.
+// Header value may carry header hash of the job miner already has.
+func (s *ProxyServer) isLongPoll(r *http.Request) (bool, string) {
+	if !s.config.Proxy.LongPoll.Enabled {
+		return false, ""
+	}
+	if v := r.Header.Get("X-Long-Poll"); len(v) > 0 {
+		return true, v
+	}
+	if len(r.URL.Query().Get("longpoll")) > 0 {
+		return true, ""
+	}
+	return false, ""
+}
+
+// Parks request until template changes, timeout elapses or miner goes away.
+// Returns right away if miner's job is already outdated or too many requests are parked.
+func (s *ProxyServer) waitNewWork(r *http.Request, known string) {
+	if t := s.currentBlockTemplate(); t != nil && hashPattern.MatchString(known) && t.Header != known {
+		return
+	}
+	parked := atomic.AddInt32(&s.longPolls, 1)
+	defer atomic.AddInt32(&s.longPolls, -1)
+	if int(parked) > s.config.Proxy.LongPoll.MaxParked {
+		metrics.GetOrRegisterCounter("proxy.longpoll.rejected", metrics.DefaultRegistry).Inc(1)
+		return
+	}
+
+	newWork := s.newWorkChan()
+	timer := time.NewTimer(s.longPollTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-newWork:
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
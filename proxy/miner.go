@@ -8,23 +8,26 @@ import (
 
 	"github.com/sero-cash/go-sero/common"
 	"github.com/sero-cash/mine-pool/progpow_go"
+	"github.com/sero-cash/mine-pool/storage"
 )
 
-//var hasher = ethash.New()
-var hasher = progpow_go.New()
-
-func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params []string) (bool, bool) {
+// Returns whether share is a duplicate, whether it is valid, whether it was rejected as stale
+// and whether it was not verified at all because verification queue is overloaded.
+func (s *ProxyServer) processShare(cs *Session, login, id string, t *BlockTemplate, params []string) (bool, bool, bool, bool) {
 	nonceHex := params[0]
 	hashNoNonce := params[1]
 	mixDigest := params[2]
 	nonce, _ := strconv.ParseUint(strings.Replace(nonceHex, "0x", "", -1), 16, 64)
-	shareDiff := s.config.Proxy.Difficulty
+	diff := s.currentDiff()
+	shareDiff := diff.difficulty
+	ip := cs.ip
 
 	h, ok := t.headers[hashNoNonce]
 	//log.Printf(">>>>>processShare %v@%v with %v,head: %v ", login, ip, id, hashNoNonce)
 	if !ok {
 		log.Printf("Stale share from %v@%v with %v", login, ip, id)
-		return false, false
+		s.writeRejectedShare(login, id, storage.ShareStale)
+		return false, false, true, false
 	}
 
 	share := Block{
@@ -35,47 +38,117 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
 		mixDigest:   common.HexToHash(mixDigest),
 	}
 
-	block := Block{
-		number:      h.height,
-		hashNoNonce: common.HexToHash(hashNoNonce),
-		difficulty:  h.diff,
-		nonce:       nonce,
-		mixDigest:   common.HexToHash(mixDigest),
+	// PoW is computed once and checked against both share and block targets
+	var result *big.Int
+	var mixOk bool
+	if !s.verifier.Do(cs.fairnessKey(), func() { result, mixOk = s.hasher.Result(share) }) {
+		log.Printf("Share verification queue is full, dropped share from %v@%v with %v", login, ip, id)
+		return false, false, false, true
 	}
-
-	if !hasher.Verify(share) {
+	valid := mixOk && progpow_go.CheckDifficulty(result, share.difficulty)
+	// Share for target handed out before difficulty change is credited with the previous difficulty
+	if previous, ok := diff.previousInGrace(); !valid && mixOk && ok && progpow_go.CheckDifficulty(result, big.NewInt(previous)) {
+		valid = true
+		shareDiff = previous
+	}
+	// Upstream pool target may be easier than share difficulty in farm mode, such solution counts at its difficulty
+	solved := mixOk && progpow_go.CheckDifficulty(result, h.diff)
+	if !valid && solved {
+		valid = true
+		shareDiff = h.diff.Int64()
+	}
+	if !valid {
 		log.Printf("processShare hasher Verify failed %v@%v with %v", login, ip, id)
-		return false, false
+		s.writeRejectedShare(login, id, storage.ShareInvalid)
+		return false, false, false, false
 	}
 
-	if hasher.Verify(block) {
-		ok, err := s.rpc().SubmitBlock(params)
+	// Farm mode, solution meets upstream pool target, forward it and account as a regular share
+	if solved && s.pool != nil {
+		ok, err := s.pool.SubmitWork(params)
 		if err != nil {
-			log.Printf("Block submission failure at height %v for %v: %v", h.height, t.Header, err)
+			log.Printf("Failed to forward share from %v@%v to upstream pool %s: %v", login, ip, s.pool.Name, err)
 		} else if !ok {
-			log.Printf("Block rejected at height %v for %v", h.height, t.Header)
-			return false, false
+			log.Printf("Upstream pool %s rejected share from %v@%v at height %v", s.pool.Name, login, ip, h.height)
+		}
+		solved = false
+	}
+
+	if solved {
+		exist, err := s.backend.WritePoW(h.height, params)
+		if exist {
+			return true, false, false, false
+		}
+		if err != nil {
+			log.Println("Failed to insert block PoW into backend:", err)
+		}
+		// Retries may take seconds, miner gets its reply right away and shutdown waits for them
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			s.submitSolution(login, id, ip, t.Header, params, shareDiff, h)
+		}()
+	} else if s.shares != nil {
+		exist, err := s.backend.WritePoW(h.height, params)
+		if exist {
+			return true, false, false, false
+		}
+		if err != nil {
+			log.Println("Failed to insert share data into backend:", err)
 		} else {
-			s.fetchBlockTemplate()
-			exist, err := s.backend.WriteBlock(login, id, params, shareDiff, h.diff.Int64(), h.height, s.hashrateExpiration)
-			if exist {
-				return true, false
-			}
-			if err != nil {
-				log.Println("Failed to insert block candidate into backend:", err)
-			} else {
-				log.Printf("Inserted block %v to backend", h.height)
-			}
-			log.Printf("Block found by miner %v@%v at height %d", login, ip, h.height)
+			s.shares.Add(login, id, shareDiff, h.diff.Int64(), h.height)
 		}
 	} else {
-		exist, err := s.backend.WriteShare(login, id, params, shareDiff, h.height, s.hashrateExpiration)
+		exist, err := s.backend.WriteShare(login, id, params, shareDiff, h.diff.Int64(), h.height, s.hashrateExpiration)
 		if exist {
-			return true, false
+			return true, false, false, false
 		}
 		if err != nil {
 			log.Println("Failed to insert share data into backend:", err)
 		}
 	}
-	return false, true
+	return false, true, false, false
+}
+
+// Submits block solution and records it as block candidate once accepted, or as failed block.
+// Share of rejected or failed solution is not credited.
+func (s *ProxyServer) submitSolution(login, id, ip, header string, params []string, shareDiff int64, h heightDiffPair) {
+	acceptor, err := s.submitBlockWithRetries(params, h.height)
+	if err != nil {
+		log.Printf("Block submission failure at height %v for %v: %v", h.height, header, err)
+		if err := s.backend.WriteFailedBlock(login, id, params, h.diff.Int64(), h.height); err != nil {
+			log.Printf("Failed to insert failed block into backend: %v", err)
+		}
+		s.alertFailedBlock(login, id, params, h.height, err)
+		return
+	}
+	if len(acceptor) == 0 {
+		log.Printf("Block rejected at height %v for %v", h.height, header)
+		return
+	}
+	log.Printf("Block at height %v accepted first by %s", h.height, acceptor)
+	s.fetchBlockTemplate()
+	// Round shares must be complete before the round is closed
+	if s.shares != nil {
+		if err := s.shares.Flush(); err != nil {
+			log.Printf("Failed to flush share batch before block at height %v: %v", h.height, err)
+		}
+	}
+	err = s.backend.WriteCheckedBlock(login, id, params, shareDiff, h.diff.Int64(), h.height, s.hashrateExpiration)
+	if err != nil {
+		log.Println("Failed to insert block candidate into backend:", err)
+	} else {
+		log.Printf("Inserted block %v to backend", h.height)
+	}
+	log.Printf("Block found by miner %v@%v at height %d", login, ip, h.height)
+	if err := s.backend.WriteBlockAcceptor(h.height, params[0], acceptor); err != nil {
+		log.Printf("Failed to record block acceptor: %v", err)
+	}
+}
+
+func (s *ProxyServer) writeRejectedShare(login, id, kind string) {
+	err := s.backend.WriteRejectedShare(login, id, kind, s.hashrateExpiration)
+	if err != nil {
+		log.Printf("Failed to count %v share in backend: %v", kind, err)
+	}
 }
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/yvasiyarov/go-metrics"
+
+	"github.com/sero-cash/mine-pool/progpow_go"
+)
+
+var (
+	powEpochGauge = metrics.GetOrRegisterGauge("proxy.pow.epoch", metrics.DefaultRegistry)
+	powWarmTimer  = metrics.GetOrRegisterTimer("proxy.pow.warm", metrics.DefaultRegistry)
+)
+
+// Configured fields are already applied on top of defaults when config is decoded.
+func newHasher(cfg *progpow_go.Config) *progpow_go.Ethash {
+	config := progpow_go.DefaultConfig
+	if cfg != nil {
+		config = *cfg
+	}
+	if len(config.CacheDir) > 0 && config.CachesOnDisk > 0 {
+		log.Printf("Keeping %v verification caches in %s", config.CachesOnDisk, config.CacheDir)
+	} else {
+		log.Printf("Verification caches are kept in memory only")
+	}
+	return progpow_go.New(config)
+}
+
+// Starts generating caches of new epoch and the one after it when chain crosses epoch boundary.
+func (s *ProxyServer) updateEpoch(height uint64) {
+	epoch := int64(progpow_go.Epoch(height))
+	if atomic.SwapInt64(&s.epoch, epoch) != epoch {
+		powEpochGauge.Update(epoch)
+		go s.warmCaches(height)
+	}
+}
+
+func (s *ProxyServer) warmCaches(height uint64) {
+	start := time.Now()
+	current, next := s.hasher.Warm(height)
+	powWarmTimer.UpdateSince(start)
+	log.Printf("Verification cache of epoch %v ready, generated in %v, next epoch %v in %v",
+		current.Epoch, current.Took, next.Epoch, next.Took)
+}
+
+// Returns whether verification cache of current epoch is ready and state of all caches in memory.
+func (s *ProxyServer) cachesStatus() (bool, []map[string]interface{}) {
+	epoch := uint64(atomic.LoadInt64(&s.epoch))
+	ready := false
+	caches := make([]map[string]interface{}, 0)
+	for _, c := range s.hasher.Caches() {
+		if c.Epoch == epoch && c.Generated {
+			ready = true
+		}
+		caches = append(caches, map[string]interface{}{
+			"epoch":     c.Epoch,
+			"generated": c.Generated,
+			"took":      c.Took.Seconds(),
+		})
+	}
+	return ready, caches
+}
@@ -11,6 +11,8 @@ type JSONRpcReq struct {
 type StratumReq struct {
 	JSONRpcReq
 	Worker string `json:"worker"`
+	// Optional miner software name, reported on login
+	Agent string `json:"agent"`
 }
 
 // Stratum
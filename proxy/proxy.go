@@ -14,6 +14,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/sero-cash/mine-pool/policy"
+	"github.com/sero-cash/mine-pool/progpow_go"
 	"github.com/sero-cash/mine-pool/rpc"
 	"github.com/sero-cash/mine-pool/storage"
 	"github.com/sero-cash/mine-pool/util"
@@ -23,17 +24,56 @@ type ProxyServer struct {
 	config             *Config
 	blockTemplate      atomic.Value
 	upstream           int32
-	upstreams          []*rpc.RPCClient
+	upstreams          atomic.Value
+	pool               *rpc.StratumClient
 	backend            *storage.RedisClient
-	diff               string
+	diff               atomic.Value
+	trustedProxies     []*net.IPNet
 	policy             *policy.PolicyServer
 	hashrateExpiration time.Duration
+	reportedExpiration time.Duration
 	failsCount         int64
+	shares             *ShareAggregator
+	verifier           *Verifier
+	hasher             *progpow_go.Ethash
+	epoch              int64
+
+	// Long-polling getwork
+	newWorkMu       sync.Mutex
+	newWork         chan struct{}
+	longPolls       int32
+	longPollTimeout time.Duration
+
+	// Push-based work
+	headSubMu  sync.Mutex
+	headSub    *rpc.HeadSubscription
+	subscribed int32
 
 	// Stratum
 	sessionsMu sync.RWMutex
 	sessions   map[*Session]*CSHashrate
-	timeout    time.Duration
+	sessionSeq uint64
+
+	// Shutdown
+	stopMu    sync.RWMutex
+	stopping  bool
+	listeners []io.Closer
+	inflight  sync.WaitGroup
+}
+
+// Node upstreams with their configs, replaced as a whole on config reload
+type upstreamSet struct {
+	clients []*rpc.RPCClient
+	config  []Upstream
+}
+
+// Share difficulty of miners and its target, replaced on config reload
+type minerDiff struct {
+	difficulty int64
+	target     string
+	// Difficulty before last change, still accepted until graceUntil in milliseconds
+	previous   int64
+	graceUntil int64
 }
 
 type CSHashrate struct {
@@ -71,13 +111,32 @@ func (cshr CSHashrate) HR() int64 {
 }
 
 type Session struct {
+	// We are using atomic with share counters,
+	// so moving them before the rest in order to avoid alignment issue
+	lastShare       int64
+	validShares     int64
+	staleShares     int64
+	invalidShares   int64
+	duplicateShares int64
+
 	ip  string
 	enc *json.Encoder
 
 	// Stratum
 	sync.Mutex
-	conn  *net.TCPConn
-	login string
+	conn     net.Conn
+	timeout  time.Duration
+	requests policy.TokenBucket
+
+	// Introspection, id is assigned once on connect
+	id          uint64
+	connectedAt int64
+
+	// Guards fields below, they are read from admin and broadcast goroutines
+	identMu sync.RWMutex
+	login   string
+	worker  string
+	agent   string
 }
 
 func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
@@ -87,24 +146,87 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	policy := policy.Start(&cfg.Proxy.Policy, backend)
 
 	proxy := &ProxyServer{config: cfg, backend: backend, policy: policy}
-	proxy.diff = util.GetTargetHex(cfg.Proxy.Difficulty)
-	log.Printf("proxy .dff %s", proxy.diff)
+	proxy.newWork = make(chan struct{})
+	if cfg.Proxy.LongPoll.Enabled {
+		proxy.longPollTimeout = util.MustParseDuration(cfg.Proxy.LongPoll.Timeout)
+	}
+	trustedProxies, err := parseTrustedNets(cfg.Proxy.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid trusted proxy: %v", err)
+	}
+	if cfg.Proxy.BehindReverseProxy && len(trustedProxies) == 0 {
+		log.Fatal("Reverse proxy mode is enabled without trusted proxies, any miner could spoof its address")
+	}
+	proxy.trustedProxies = trustedProxies
+	proxy.setDifficulty(cfg.Proxy.Difficulty)
+	log.Printf("proxy .dff %s", proxy.currentDiff().target)
 
-	proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
-	for i, v := range cfg.Upstream {
-		proxy.upstreams[i] = rpc.NewRPCClient(v.Name, v.Url, v.Timeout)
-		log.Printf("Upstream: %s => %s", v.Name, v.Url)
+	switch cfg.Proxy.ShareVerify.Overload {
+	case "", overloadWait, overloadReject, overloadShed:
+	default:
+		log.Fatalf("Unknown share verification overload policy %q", cfg.Proxy.ShareVerify.Overload)
+	}
+	proxy.verifier = NewVerifier(&cfg.Proxy.ShareVerify)
+	proxy.verifier.Start()
+	proxy.hasher = newHasher(cfg.Proxy.ProgPoW)
+	proxy.epoch = -1
+
+	for _, v := range cfg.Upstream {
+		if v.Type == upstreamPool {
+			if len(cfg.Upstream) > 1 {
+				log.Fatal("Upstream pool can't be combined with other upstreams")
+			}
+			proxy.pool = rpc.NewStratumClient(v.Name, v.Url, v.Login, v.Worker, v.Timeout)
+			log.Printf("Upstream pool: %s => %s as %s", v.Name, v.Url, v.Login)
+		}
+	}
+	if proxy.pool == nil {
+		proxy.upstreams.Store(newUpstreamSet(cfg.Upstream))
+		log.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
+	} else {
+		proxy.upstreams.Store(&upstreamSet{})
 	}
-	log.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
 
-	if cfg.Proxy.Stratum.Enabled {
+	if cfg.Proxy.Stratum.Enabled || cfg.Proxy.WebSocket.Enabled {
 		proxy.sessions = make(map[*Session]*CSHashrate)
-		go proxy.ListenTCP()
 	}
 
+	// Everything miner handlers use is set before any job is fetched or listener started
+	proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
+	if len(cfg.Proxy.ReportedHashrateExpiration) > 0 {
+		proxy.reportedExpiration = util.MustParseDuration(cfg.Proxy.ReportedHashrateExpiration)
+	}
+
+	if cfg.Proxy.ShareBatch.Enabled {
+		proxy.shares = NewShareAggregator(&cfg.Proxy.ShareBatch, backend, proxy.hashrateExpiration)
+		proxy.shares.Start(util.MustParseDuration(cfg.Proxy.ShareBatch.Interval))
+	}
+
+	if proxy.pool != nil {
+		proxy.pool.Start(proxy.fetchBlockTemplate)
+	}
 	proxy.fetchBlockTemplate()
+	if proxy.pool == nil {
+		go proxy.subscribeWork()
+	}
+	// Don't let first shares wait for cache generation
+	if t := proxy.currentBlockTemplate(); t != nil {
+		log.Printf("Warming up verification caches for height %v", t.Height)
+		proxy.hasher.Warm(t.Height)
+	} else {
+		log.Printf("No work yet, verification caches will be generated on first job")
+	}
 
-	proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
+	if cfg.Proxy.Stratum.Enabled {
+		go proxy.ListenTCP()
+	}
+	if cfg.Proxy.WebSocket.Enabled {
+		go proxy.ListenWebSocket()
+	}
+
+	if cfg.Proxy.Admin.Enabled {
+		go proxy.ListenAdmin()
+	}
 
 	refreshIntv := util.MustParseDuration(cfg.Proxy.BlockRefreshInterval)
 	refreshTimer := time.NewTimer(refreshIntv)
@@ -117,10 +239,17 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	stateUpdateTimer := time.NewTimer(stateUpdateIntv)
 
 	go func() {
+		var skipped time.Duration
 		for {
 			select {
 			case <-refreshTimer.C:
-				proxy.fetchBlockTemplate()
+				// Slow poll while subscribed, in case node stops sending heads
+				if !proxy.isSubscribed() || skipped >= subscribedRefreshInterval {
+					proxy.fetchBlockTemplate()
+					skipped = 0
+				} else {
+					skipped += refreshIntv
+				}
 				refreshTimer.Reset(refreshIntv)
 			}
 		}
@@ -168,32 +297,66 @@ func (s *ProxyServer) Start() {
 		Handler:        context.ClearHandler(r),
 		MaxHeaderBytes: s.config.Proxy.LimitHeadersSize,
 	}
-	err := srv.ListenAndServe()
+	l, err := net.Listen("tcp", s.config.Proxy.Listen)
 	if err != nil {
 		log.Fatalf("Failed to start proxy: %v", err)
 	}
+	if s.config.Proxy.ProxyProtocol.Http {
+		l = newProxyProtoListener(l, &s.config.Proxy.ProxyProtocol)
+	}
+	if !s.trackListener(srv) {
+		return
+	}
+	err = srv.Serve(l)
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Failed to start proxy: %v", err)
+	}
 }
 
-func (s *ProxyServer) rpc() *rpc.RPCClient {
-	i := atomic.LoadInt32(&s.upstream)
-	return s.upstreams[i]
+func newUpstreamSet(upstreams []Upstream) *upstreamSet {
+	set := &upstreamSet{config: upstreams}
+	set.clients = make([]*rpc.RPCClient, len(upstreams))
+	for i, v := range upstreams {
+		set.clients[i] = rpc.NewRPCClient(v.Name, v.Url, v.Timeout)
+		log.Printf("Upstream: %s => %s", v.Name, v.Url)
+	}
+	return set
 }
 
-func (s *ProxyServer) checkUpstreams() {
-	candidate := int32(0)
-	backup := false
+func (s *ProxyServer) currentUpstreams() *upstreamSet {
+	return s.upstreams.Load().(*upstreamSet)
+}
 
-	for i, v := range s.upstreams {
-		if v.Check() && !backup {
-			candidate = int32(i)
-			backup = true
-		}
+// Index of active upstream, falls back to the first one if list was just replaced by a shorter one.
+func (s *ProxyServer) upstreamIndex(set *upstreamSet) int32 {
+	i := atomic.LoadInt32(&s.upstream)
+	if int(i) >= len(set.clients) {
+		return 0
 	}
+	return i
+}
+
+func (s *ProxyServer) rpc() *rpc.RPCClient {
+	set := s.currentUpstreams()
+	return set.clients[s.upstreamIndex(set)]
+}
 
-	if s.upstream != candidate {
-		log.Printf("Switching to %v upstream", s.upstreams[candidate].Name)
-		atomic.StoreInt32(&s.upstream, candidate)
+func (s *ProxyServer) setDifficulty(difficulty int64) {
+	d := &minerDiff{difficulty: difficulty, target: util.GetTargetHex(difficulty)}
+	if old, ok := s.diff.Load().(*minerDiff); ok {
+		d.previous = old.difficulty
+		d.graceUntil = util.MakeTimestamp() + int64(difficultyChangeGrace/time.Millisecond)
 	}
+	s.diff.Store(d)
+}
+
+// Returns difficulty handed out before last change while miners may still submit shares for it.
+func (d *minerDiff) previousInGrace() (int64, bool) {
+	return d.previous, d.previous > 0 && util.MakeTimestamp() < d.graceUntil
+}
+
+func (s *ProxyServer) currentDiff() *minerDiff {
+	return s.diff.Load().(*minerDiff)
 }
 
 func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -207,17 +370,6 @@ func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *ProxyServer) remoteAddr(r *http.Request) string {
-	if s.config.Proxy.BehindReverseProxy {
-		ip := r.Header.Get("X-Forwarded-For")
-		if len(ip) > 0 && net.ParseIP(ip) != nil {
-			return ip
-		}
-	}
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return ip
-}
-
 func (s *ProxyServer) handleClient(w http.ResponseWriter, r *http.Request, ip string) {
 	if r.ContentLength > s.config.Proxy.LimitBodySize {
 		log.Printf("Socket flood from %s", ip)
@@ -258,15 +410,21 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 		cs.sendError(req.Id, errReply)
 		return
 	}
-	if !s.policy.ApplyLoginPolicy(login, cs.ip) {
-		errReply := &ErrorReply{Code: -1, Message: "You are blacklisted"}
-		cs.sendError(req.Id, errReply)
+	if err := s.policy.ApplyLoginPolicy(login, cs.ip); err != nil {
+		cs.sendError(req.Id, loginPolicyError(err))
 		return
 	}
 
 	// Handle RPC methods
 	switch req.Method {
 	case "sero_getWork":
+		if !s.policy.AllowGetWork(cs.ip) {
+			cs.sendError(req.Id, errRateLimited)
+			break
+		}
+		if ok, known := s.isLongPoll(r); ok {
+			s.waitNewWork(r, known)
+		}
 		reply, errReply := s.handleGetWorkRPC(cs)
 		if errReply != nil {
 			cs.sendError(req.Id, errReply)
@@ -299,7 +457,15 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 		reply := s.handleGetBlockByNumberRPC()
 		cs.sendResult(req.Id, reply)
 	case "sero_submitHashrate":
-		cs.sendResult(req.Id, true)
+		var params []string
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			log.Printf("Unable to parse params from %v", cs.ip)
+			s.policy.ApplyMalformedPolicy(cs.ip)
+			break
+		}
+		reply := s.handleSubmitHashrateRPC(cs, login, vars["id"], params)
+		cs.sendResult(req.Id, reply)
 	default:
 		errReply := s.handleUnknownRPC(cs, req.Method)
 		cs.sendError(req.Id, errReply)
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sero-cash/mine-pool/util"
+)
+
+// Binary header signature of PROXY protocol v2
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Longest valid PROXY protocol v1 line including CRLF
+const proxyV1MaxLen = 107
+
+var errProxyListenerClosed = errors.New("PROXY protocol listener is closed")
+
+// Accepts connections from load balancers speaking HAProxy PROXY protocol v1 or v2.
+// Header is honored and required only from trusted sources, other peers are served as direct clients.
+// Headers are read in background, so slow peer does not hold up accepting of others.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+	conns   chan net.Conn
+	errs    chan error
+
+	// Closed on Close or fatal accept error, err is set before
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// Client connection with address taken from PROXY protocol header
+type proxyProtoConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func parseTrustedNets(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, v := range cidrs {
+		n, err := util.ParseIPNet(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func newProxyProtoListener(l net.Listener, cfg *ProxyProtocol) *proxyProtoListener {
+	trusted, err := parseTrustedNets(cfg.Trusted)
+	if err != nil {
+		log.Fatalf("Invalid PROXY protocol trusted source: %v", err)
+	}
+	if len(trusted) == 0 {
+		log.Fatal("PROXY protocol is enabled without trusted sources")
+	}
+	p := &proxyProtoListener{
+		Listener: l,
+		trusted:  trusted,
+		timeout:  util.MustParseDuration(cfg.Timeout),
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go p.acceptLoop()
+	return p
+}
+
+func (p *proxyProtoListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case err := <-p.errs:
+		return nil, err
+	case <-p.done:
+		return nil, p.err
+	}
+}
+
+func (p *proxyProtoListener) Close() error {
+	p.shutdown(errProxyListenerClosed)
+	return p.Listener.Close()
+}
+
+// Makes every pending and later Accept return err, first error wins
+func (p *proxyProtoListener) shutdown(err error) {
+	p.closeOnce.Do(func() {
+		p.err = err
+		close(p.done)
+	})
+}
+
+// Hands connection over to Accept, closes it if listener is closed meanwhile
+func (p *proxyProtoListener) deliver(conn net.Conn) {
+	select {
+	case p.conns <- conn:
+	case <-p.done:
+		conn.Close()
+	}
+}
+
+func (p *proxyProtoListener) acceptLoop() {
+	for {
+		conn, err := p.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				select {
+				case p.errs <- err:
+				case <-p.done:
+					return
+				}
+				continue
+			}
+			p.shutdown(err)
+			return
+		}
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetKeepAlive(true)
+		}
+		go func(conn net.Conn) {
+			if !p.isTrusted(conn.RemoteAddr()) {
+				p.deliver(conn)
+				return
+			}
+			proxied, err := p.readHeader(conn)
+			if err != nil {
+				log.Printf("Invalid PROXY protocol header from %v: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			p.deliver(proxied)
+		}(conn)
+	}
+}
+
+func (p *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range p.trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *proxyProtoListener) readHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(p.timeout))
+	reader := bufio.NewReader(conn)
+	remote, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	// LOCAL command and unknown protocols keep the address of connection itself
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyProtoConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+// Consumes PROXY protocol header of either version, returns nil address if header carries no client.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	sig, err := reader.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyHeaderV2(reader)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyHeaderV1(reader)
+	}
+	return nil, errors.New("missing header")
+}
+
+// PROXY TCP4|TCP6|UNKNOWN <src> <dst> <sport> <dport>\r\n
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header is too long")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(reader, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	switch hdr[12] & 0xf {
+	case 0x0:
+		// LOCAL, health check of balancer itself
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", hdr[12]&0xf)
+	}
+
+	// Address family in the high nibble, only stream transport carries miners
+	switch hdr[13] {
+	case 0x11:
+		if length < 12 {
+			return nil, errors.New("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21:
+		if length < 36 {
+			return nil, errors.New("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Builds v2 header with given version/command and family/transport bytes
+func proxyV2Header(verCmd, famProto byte, payload []byte) []byte {
+	hdr := append([]byte{}, proxyV2Sig...)
+	hdr = append(hdr, verCmd, famProto, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:16], uint16(len(payload)))
+	return append(hdr, payload...)
+}
+
+func proxyV2Addrs(src, dst net.IP, sport, dport uint16) []byte {
+	var b bytes.Buffer
+	b.Write(src)
+	b.Write(dst)
+	binary.Write(&b, binary.BigEndian, sport)
+	binary.Write(&b, binary.BigEndian, dport)
+	return b.Bytes()
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		header string
+		addr   string
+		fail   bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 8008\r\n", "192.0.2.1:56324", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 8008\r\n", "[2001:db8::1]:56324", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 8008\r\n", "", false},
+		// Family must match address
+		{"PROXY TCP4 2001:db8::1 2001:db8::2 56324 8008\r\n", "", true},
+		{"PROXY TCP6 192.0.2.1 198.51.100.1 56324 8008\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 65536 8008\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 -1 8008\r\n", "", true},
+		{"PROXY TCP4 example.com 198.51.100.1 56324 8008\r\n", "", true},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 8008\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 8008\n", "", true},
+		{"PROXY TCP4 192.0.2.1 " + strings.Repeat("1", proxyV1MaxLen) + "\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1", "", true},
+		{"GET / HTTP/1.1\r\n\r\n", "", true},
+	}
+	for _, test := range tests {
+		addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(test.header)))
+		if test.fail {
+			if err == nil {
+				t.Errorf("Header %q must be rejected, got %v", test.header, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Header %q must be accepted: %v", test.header, err)
+			continue
+		}
+		if (addr == nil && len(test.addr) > 0) || (addr != nil && addr.String() != test.addr) {
+			t.Errorf("Header %q must give %q, got %v", test.header, test.addr, addr)
+		}
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	v4 := proxyV2Addrs(net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4(), 56324, 8008)
+	v6 := proxyV2Addrs(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 56324, 8008)
+
+	tests := []struct {
+		name   string
+		header []byte
+		addr   string
+		fail   bool
+	}{
+		{"ipv4", proxyV2Header(0x21, 0x11, v4), "192.0.2.1:56324", false},
+		{"ipv6", proxyV2Header(0x21, 0x21, v6), "[2001:db8::1]:56324", false},
+		// Trailing TLVs are consumed with address block
+		{"ipv4 with tlv", proxyV2Header(0x21, 0x11, append(v4, 0x04, 0x00, 0x01, 0xff)), "192.0.2.1:56324", false},
+		{"local", proxyV2Header(0x20, 0x00, nil), "", false},
+		{"udp", proxyV2Header(0x21, 0x12, v4), "", false},
+		{"unix", proxyV2Header(0x21, 0x31, make([]byte, 216)), "", false},
+		{"version 1", proxyV2Header(0x11, 0x11, v4), "", true},
+		{"unknown command", proxyV2Header(0x22, 0x11, v4), "", true},
+		{"short ipv4", proxyV2Header(0x21, 0x11, v4[:8]), "", true},
+		{"short ipv6", proxyV2Header(0x21, 0x21, v4), "", true},
+		{"truncated payload", proxyV2Header(0x21, 0x11, v4)[:20], "", true},
+		{"truncated header", proxyV2Header(0x21, 0x11, v4)[:14], "", true},
+	}
+	for _, test := range tests {
+		reader := bufio.NewReader(bytes.NewReader(append(test.header, "data"...)))
+		addr, err := readProxyHeader(reader)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: header must be rejected, got %v", test.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: header must be accepted: %v", test.name, err)
+			continue
+		}
+		if (addr == nil && len(test.addr) > 0) || (addr != nil && addr.String() != test.addr) {
+			t.Errorf("%s: header must give %q, got %v", test.name, test.addr, addr)
+		}
+		// Client data must follow header untouched
+		if rest, _ := reader.ReadString(0); rest != "data" {
+			t.Errorf("%s: header must be consumed exactly, left %q", test.name, rest)
+		}
+	}
+}
+
+func TestProxyProtoListenerClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	p := newProxyProtoListener(l, &ProxyProtocol{Trusted: []string{"127.0.0.1"}, Timeout: "1s"})
+
+	// Trusted peer never completes header, its goroutine must not outlive listener
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 8008\r\n"))
+	time.Sleep(100 * time.Millisecond)
+
+	p.Close()
+	for i := 0; i < 2; i++ {
+		accepted := make(chan error, 1)
+		go func() {
+			_, err := p.Accept()
+			accepted <- err
+		}()
+		select {
+		case err := <-accepted:
+			if err == nil {
+				t.Error("Accept must fail after close")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Accept must not block after close")
+		}
+	}
+	// Pending proxied connection is closed rather than left for Accept
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Connection delivered after close must be closed")
+	}
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// Shares meeting difficulty handed out before reload are accepted for this long
+const difficultyChangeGrace = 2 * time.Minute
+
+// Applies sections of new config that are safe to change at runtime: share difficulty,
+// policy thresholds and node upstreams. Everything else requires restart.
+func (s *ProxyServer) Reload(cfg *Config) error {
+	if cfg.Proxy.Difficulty <= 0 {
+		return errors.New("share difficulty must be positive")
+	}
+	if err := s.checkUpstreamsConfig(cfg.Upstream); err != nil {
+		return err
+	}
+	if err := s.policy.Reload(&cfg.Proxy.Policy); err != nil {
+		return err
+	}
+
+	if cfg.Proxy.Difficulty != s.currentDiff().difficulty {
+		s.setDifficulty(cfg.Proxy.Difficulty)
+		log.Printf("Share difficulty changed to %v", cfg.Proxy.Difficulty)
+		// Hand out new target right away, shares for the previous one are accepted during grace
+		if s.config.Proxy.Stratum.Enabled || s.config.Proxy.WebSocket.Enabled {
+			go s.broadcastNewJobs()
+		}
+	}
+
+	if s.pool == nil && !reflect.DeepEqual(cfg.Upstream, s.currentUpstreams().config) {
+		s.upstreams.Store(newUpstreamSet(cfg.Upstream))
+		atomic.StoreInt32(&s.upstream, 0)
+		s.checkUpstreams()
+		s.resubscribeWork()
+		log.Printf("Reloaded upstreams, active upstream: %s => %s", s.rpc().Name, s.rpc().Url)
+	}
+	return nil
+}
+
+func (s *ProxyServer) checkUpstreamsConfig(upstreams []Upstream) error {
+	if s.pool != nil {
+		if len(upstreams) != 1 || upstreams[0].Type != upstreamPool {
+			return errors.New("upstream pool can't be replaced without restart")
+		}
+		return nil
+	}
+	if len(upstreams) == 0 {
+		return errors.New("upstream list is empty")
+	}
+	for _, v := range upstreams {
+		if v.Type == upstreamPool {
+			return errors.New("switching to upstream pool requires restart")
+		}
+		if _, err := time.ParseDuration(v.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout of upstream %s: %v", v.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/yvasiyarov/go-metrics"
+
+	"github.com/sero-cash/mine-pool/storage"
+	"github.com/sero-cash/mine-pool/util"
+)
+
+// Accumulates valid shares in memory and writes them to backend in batches
+type ShareAggregator struct {
+	sync.Mutex
+	backend    *storage.RedisClient
+	window     time.Duration
+	maxPending int
+	pending    []*storage.Share
+	height     uint64
+
+	// Serializes flushes, so shares reach backend in submission order
+	flushMu sync.Mutex
+
+	flushTimer   metrics.Timer
+	batchSize    metrics.Histogram
+	pendingGauge metrics.Gauge
+	dropped      metrics.Counter
+	failures     metrics.Counter
+}
+
+func NewShareAggregator(cfg *ShareBatch, backend *storage.RedisClient, window time.Duration) *ShareAggregator {
+	a := &ShareAggregator{backend: backend, window: window, maxPending: cfg.MaxPending}
+	if a.maxPending <= 0 {
+		a.maxPending = 10000
+	}
+	a.pending = make([]*storage.Share, 0, a.maxPending)
+	a.flushTimer = metrics.GetOrRegisterTimer("proxy.shares.flush", metrics.DefaultRegistry)
+	a.batchSize = metrics.GetOrRegisterHistogram("proxy.shares.batch", metrics.DefaultRegistry, metrics.NewExpDecaySample(1028, 0.015))
+	a.pendingGauge = metrics.GetOrRegisterGauge("proxy.shares.pending", metrics.DefaultRegistry)
+	a.dropped = metrics.GetOrRegisterCounter("proxy.shares.dropped", metrics.DefaultRegistry)
+	a.failures = metrics.GetOrRegisterCounter("proxy.shares.flushFailures", metrics.DefaultRegistry)
+	return a
+}
+
+func (a *ShareAggregator) Start(intv time.Duration) {
+	timer := time.NewTimer(intv)
+	log.Printf("Set share batch flush every %v, up to %v pending shares", intv, a.maxPending)
+
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				err := a.Flush()
+				if err != nil {
+					log.Printf("Failed to flush share batch to backend: %v", err)
+				}
+				timer.Reset(intv)
+			}
+		}
+	}()
+}
+
+// Queues share, flushes right away in caller's goroutine once buffer is full.
+func (a *ShareAggregator) Add(login, id string, diff, netDiff int64, height uint64) {
+	a.Lock()
+	a.pending = append(a.pending, &storage.Share{Login: login, Id: id, Difficulty: diff, NetworkDifficulty: netDiff, Timestamp: util.MakeTimestamp()})
+	if height > a.height {
+		a.height = height
+	}
+	full := len(a.pending) >= a.maxPending
+	a.pendingGauge.Update(int64(len(a.pending)))
+	a.Unlock()
+
+	if full {
+		err := a.Flush()
+		if err != nil {
+			log.Printf("Failed to flush full share batch to backend: %v", err)
+		}
+	}
+}
+
+// Writes all pending shares. Failed batch is put back unless buffer has no room left for it.
+func (a *ShareAggregator) Flush() error {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+
+	a.Lock()
+	batch := a.pending
+	height := a.height
+	a.pending = make([]*storage.Share, 0, a.maxPending)
+	a.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+	start := time.Now()
+	err := a.backend.WriteShares(batch, height, a.window)
+	a.flushTimer.UpdateSince(start)
+	a.batchSize.Update(int64(len(batch)))
+
+	if err != nil {
+		a.failures.Inc(1)
+		a.Lock()
+		if len(batch)+len(a.pending) <= a.maxPending {
+			a.pending = append(batch, a.pending...)
+		} else {
+			a.dropped.Inc(int64(len(batch)))
+			log.Printf("Share buffer is full, dropped %v shares", len(batch))
+		}
+		a.pendingGauge.Update(int64(len(a.pending)))
+		a.Unlock()
+		return err
+	}
+	a.Lock()
+	a.pendingGauge.Update(int64(len(a.pending)))
+	a.Unlock()
+	return nil
+}
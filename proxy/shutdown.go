@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Registers listener to be closed on shutdown, returns false if shutdown has already begun.
+func (s *ProxyServer) trackListener(l io.Closer) bool {
+	s.stopMu.Lock()
+	defer s.stopMu.Unlock()
+	if s.stopping {
+		l.Close()
+		return false
+	}
+	s.listeners = append(s.listeners, l)
+	return true
+}
+
+func (s *ProxyServer) isStopping() bool {
+	s.stopMu.RLock()
+	defer s.stopMu.RUnlock()
+	return s.stopping
+}
+
+// Marks share as being processed, so shutdown waits for it. Caller must call inflight.Done when finished.
+func (s *ProxyServer) beginShare() bool {
+	s.stopMu.RLock()
+	defer s.stopMu.RUnlock()
+	if s.stopping {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
+}
+
+// Stops accepting miners, waits up to timeout for shares being processed and HTTP responses
+// to be written, writes out buffered shares and disconnects stratum sessions.
+func (s *ProxyServer) Stop(timeout time.Duration) {
+	s.stopMu.Lock()
+	s.stopping = true
+	listeners := s.listeners
+	s.listeners = nil
+	s.stopMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var servers sync.WaitGroup
+	for _, l := range listeners {
+		srv, ok := l.(*http.Server)
+		if !ok {
+			l.Close()
+			continue
+		}
+		servers.Add(1)
+		go func(srv *http.Server) {
+			defer servers.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+			}
+		}(srv)
+	}
+	// Release parked long-polls
+	s.signalNewWork()
+	s.policy.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		servers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Timed out waiting for shares in flight after %v", timeout)
+	}
+
+	if s.shares != nil {
+		if err := s.shares.Flush(); err != nil {
+			log.Printf("Failed to flush share batch on shutdown: %v", err)
+		}
+	}
+
+	s.sessionsMu.RLock()
+	for cs := range s.sessions {
+		cs.conn.Close()
+	}
+	n := len(s.sessions)
+	s.sessionsMu.RUnlock()
+	log.Printf("Proxy stopped, disconnected %v stratum sessions", n)
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/sero-cash/mine-pool/util"
@@ -19,16 +20,22 @@ const (
 
 func (s *ProxyServer) ListenTCP() {
 	timeout := util.MustParseDuration(s.config.Proxy.Stratum.Timeout)
-	s.timeout = timeout
 
 	addr, err := net.ResolveTCPAddr("tcp", s.config.Proxy.Stratum.Listen)
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
-	server, err := net.ListenTCP("tcp", addr)
+	var server net.Listener
+	server, err = net.ListenTCP("tcp", addr)
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
+	if s.config.Proxy.ProxyProtocol.Stratum {
+		server = newProxyProtoListener(server, &s.config.Proxy.ProxyProtocol)
+	}
+	if !s.trackListener(server) {
+		return
+	}
 	defer server.Close()
 
 	log.Printf("Stratum listening on %s", s.config.Proxy.Stratum.Listen)
@@ -36,20 +43,29 @@ func (s *ProxyServer) ListenTCP() {
 	n := 0
 
 	for {
-		conn, err := server.AcceptTCP()
+		conn, err := server.Accept()
 		if err != nil {
+			if s.isStopping() {
+				return
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				log.Printf("Stratum listener failed: %v", err)
+				return
+			}
 			continue
 		}
-		conn.SetKeepAlive(true)
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetKeepAlive(true)
+		}
 
 		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 
-		if s.policy.IsBanned(ip) || !s.policy.ApplyLimitPolicy(ip) {
+		if s.policy.IsBanned(ip) || !s.policy.AllowConnection(ip) || !s.policy.ApplyLimitPolicy(ip) {
 			conn.Close()
 			continue
 		}
 		n += 1
-		cs := &Session{conn: conn, ip: ip}
+		cs := &Session{conn: conn, ip: ip, timeout: timeout, id: s.nextSessionId(), connectedAt: util.MakeTimestamp()}
 
 		accept <- n
 		go func(cs *Session) {
@@ -66,7 +82,7 @@ func (s *ProxyServer) ListenTCP() {
 func (s *ProxyServer) handleTCPClient(cs *Session) error {
 	cs.enc = json.NewEncoder(cs.conn)
 	connbuff := bufio.NewReaderSize(cs.conn, MaxReqSize)
-	s.setDeadline(cs.conn)
+	cs.setDeadline()
 
 	for {
 		data, isPrefix, err := connbuff.ReadLine()
@@ -91,7 +107,7 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 				log.Printf("Malformed stratum request from %s: %v", cs.ip, err)
 				return err
 			}
-			s.setDeadline(cs.conn)
+			cs.setDeadline()
 			err = cs.handleTCPMessage(s, &req)
 			if err != nil {
 				return err
@@ -102,6 +118,13 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 }
 
 func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
+	if !s.policy.AllowRequest(&cs.requests, cs.ip) {
+		// Penalty may have banned the client
+		if s.policy.IsBanned(cs.ip) {
+			return cs.sendTCPError(req.Id, errRateLimited)
+		}
+		return cs.sendTCPReject(req.Id, errRateLimited)
+	}
 	// Handle RPC methods
 	switch req.Method {
 	case "sero_submitLogin":
@@ -111,6 +134,9 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 			log.Printf("Malformed stratum request params from %v,err:%v", cs.ip, err)
 			return err
 		}
+		if len(req.Agent) > 0 {
+			cs.setAgent(req.Agent)
+		}
 		reply, errReply := s.handleLoginRPC(cs, params, req.Worker)
 		if errReply != nil {
 			return cs.sendTCPError(req.Id, errReply)
@@ -130,12 +156,27 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 			return err
 		}
 		reply, errReply := s.handleTCPSubmitRPC(cs, req.Worker, params)
+		if errReply == errStaleShare || errReply == errServerBusy {
+			return cs.sendTCPReject(req.Id, errReply)
+		}
 		if errReply != nil {
 			return cs.sendTCPError(req.Id, errReply)
 		}
 		return cs.sendTCPResult(req.Id, &reply)
 	case "sero_submitHashrate":
-		return cs.sendTCPResult(req.Id, true)
+		var params []string
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			log.Println("Malformed stratum request params from", cs.ip)
+			return err
+		}
+		login, worker := cs.identity()
+		id := req.Worker
+		if len(id) == 0 {
+			id = worker
+		}
+		reply := len(login) > 0 && s.handleSubmitHashrateRPC(cs, login, id, params)
+		return cs.sendTCPResult(req.Id, reply)
 	default:
 		errReply := s.handleUnknownRPC(cs, req.Method)
 		return cs.sendTCPError(req.Id, errReply)
@@ -170,19 +211,61 @@ func (cs *Session) sendTCPError(id json.RawMessage, reply *ErrorReply) error {
 	return errors.New(reply.Message)
 }
 
-func (self *ProxyServer) setDeadline(conn *net.TCPConn) {
-	conn.SetDeadline(time.Now().Add(self.timeout))
+// Replies with error but keeps connection open
+func (cs *Session) sendTCPReject(id json.RawMessage, reply *ErrorReply) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	message := JSONRpcResp{Id: id, Version: "2.0", Error: reply}
+	return cs.enc.Encode(&message)
+}
+
+func (cs *Session) setDeadline() {
+	cs.conn.SetDeadline(time.Now().Add(cs.timeout))
+}
+
+func (cs *Session) identity() (login, worker string) {
+	cs.identMu.RLock()
+	defer cs.identMu.RUnlock()
+	return cs.login, cs.worker
 }
 
+func (cs *Session) setIdentity(login, worker string) {
+	cs.identMu.Lock()
+	defer cs.identMu.Unlock()
+	cs.login = login
+	cs.worker = worker
+}
+
+// Keeps agent reported first
+func (cs *Session) setAgent(agent string) {
+	cs.identMu.Lock()
+	defer cs.identMu.Unlock()
+	if len(cs.agent) == 0 {
+		cs.agent = agent
+	}
+}
+
+func (s *ProxyServer) nextSessionId() uint64 {
+	return atomic.AddUint64(&s.sessionSeq, 1)
+}
+
+// Keeps hashrate of session which logs in again
 func (s *ProxyServer) registerSession(cs *Session) {
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
-	s.sessions[cs] = NewCSHashrate()
+	if _, ok := s.sessions[cs]; !ok {
+		s.sessions[cs] = NewCSHashrate()
+	}
 }
 
 func (s *ProxyServer) removeSession(cs *Session) {
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
+	if _, ok := s.sessions[cs]; ok {
+		login, _ := cs.identity()
+		s.policy.ReleaseWorker(login)
+	}
 	delete(s.sessions, cs)
 }
 
@@ -191,7 +274,7 @@ func (s *ProxyServer) broadcastNewJobs() {
 	if t == nil || len(t.Header) == 0 || s.isSick() {
 		return
 	}
-	reply := []string{t.Header, t.Seed, s.diff, strconv.FormatUint(t.Height, 10)}
+	reply := []string{t.Header, t.Seed, s.currentDiff().target, strconv.FormatUint(t.Height, 10)}
 
 	s.sessionsMu.RLock()
 	defer s.sessionsMu.RUnlock()
@@ -211,10 +294,11 @@ func (s *ProxyServer) broadcastNewJobs() {
 			err := cs.pushNewJob(&reply)
 			<-bcast
 			if err != nil {
-				log.Printf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
+				login, _ := cs.identity()
+				log.Printf("Job transmit error to %v@%v: %v", login, cs.ip, err)
 				s.removeSession(cs)
 			} else {
-				s.setDeadline(cs.conn)
+				cs.setDeadline()
 			}
 		}(m)
 	}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/yvasiyarov/go-metrics"
+
+	"github.com/sero-cash/mine-pool/util"
+)
+
+const defaultSubmitBackoff = 250 * time.Millisecond
+
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+// Submits block and keeps retrying on errors with growing backoff while the block is still on top of the chain.
+// Upstreams which are marked sick are tried too on retries.
+func (s *ProxyServer) submitBlockWithRetries(params []string, height uint64) (string, error) {
+	acceptor, err := s.submitBlock(params, false)
+	if err == nil {
+		return acceptor, nil
+	}
+	backoff := defaultSubmitBackoff
+	if len(s.config.Proxy.BlockSubmit.Backoff) > 0 {
+		backoff = util.MustParseDuration(s.config.Proxy.BlockSubmit.Backoff)
+	}
+	for i := 1; i <= s.config.Proxy.BlockSubmit.Retries; i++ {
+		time.Sleep(backoff)
+		if t := s.currentBlockTemplate(); t != nil && t.Height > height {
+			return "", fmt.Errorf("chain moved to height %v, last error: %v", t.Height, err)
+		}
+		log.Printf("Retrying block submission at height %v, attempt %v: %v", height, i, err)
+		acceptor, err = s.submitBlock(params, true)
+		if err == nil {
+			return acceptor, nil
+		}
+		backoff *= 2
+	}
+	return "", err
+}
+
+// Reports valid block solution which was lost because no upstream accepted it.
+func (s *ProxyServer) alertFailedBlock(login, id string, params []string, height uint64, reason error) {
+	metrics.GetOrRegisterCounter("proxy.blocks.submitFailed", metrics.DefaultRegistry).Inc(1)
+	log.Printf("ALERT: Valid block at height %v found by %v with %v was not submitted: %v", height, login, id, reason)
+
+	url := s.config.Proxy.BlockSubmit.AlertUrl
+	if len(url) == 0 {
+		return
+	}
+	alert := map[string]interface{}{
+		"instance": s.config.Name,
+		"event":    "blockSubmitFailed",
+		"height":   height,
+		"login":    login,
+		"worker":   id,
+		"nonce":    params[0],
+		"powHash":  params[1],
+		"error":    reason.Error(),
+	}
+	data, _ := json.Marshal(alert)
+	go func() {
+		resp, err := alertClient.Post(url, "application/json", bytes.NewBuffer(data))
+		if err != nil {
+			log.Printf("Failed to send block alert: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
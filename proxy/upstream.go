@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sero-cash/mine-pool/rpc"
+)
+
+// Upstreams at the same height within this latency difference are considered equal,
+// so active upstream is not switched on network jitter
+const latencyTolerance = 20 * time.Millisecond
+
+// Upstream type that makes this instance a farm proxy of another pool
+const upstreamPool = "pool"
+
+// Selects healthy upstream with the highest chain tip, lower latency wins among equal tips.
+func (s *ProxyServer) checkUpstreams() {
+	set := s.currentUpstreams()
+	upstreams := set.clients
+	// Farm mode has no node upstreams
+	if len(upstreams) == 0 {
+		return
+	}
+	healthy := make([]bool, len(upstreams))
+	var wg sync.WaitGroup
+	for i, v := range upstreams {
+		wg.Add(1)
+		go func(i int, v *rpc.RPCClient) {
+			defer wg.Done()
+			healthy[i] = v.CheckStatus()
+		}(i, v)
+	}
+	wg.Wait()
+
+	current := s.upstreamIndex(set)
+	candidate := int32(-1)
+	var bestHeight int64
+	var bestLatency time.Duration
+	for i, v := range upstreams {
+		if !healthy[i] {
+			continue
+		}
+		height, latency := v.Status()
+		if candidate < 0 || height > bestHeight || (height == bestHeight && latency < bestLatency) {
+			candidate = int32(i)
+			bestHeight = height
+			bestLatency = latency
+		}
+	}
+	// Keep the first upstream as default when none of them is available, as before
+	if candidate < 0 {
+		candidate = 0
+	} else if healthy[current] && candidate != current {
+		height, latency := upstreams[current].Status()
+		if height == bestHeight && latency-bestLatency <= latencyTolerance {
+			candidate = current
+		}
+	}
+
+	if atomic.LoadInt32(&s.upstream) != candidate {
+		height, latency := upstreams[candidate].Status()
+		log.Printf("Switching to %v upstream at height %v, latency %v", upstreams[candidate].Name, height, latency)
+		atomic.StoreInt32(&s.upstream, candidate)
+		s.resubscribeWork()
+	}
+}
+
+type submitResult struct {
+	name string
+	ok   bool
+	err  error
+}
+
+// Submits block to the active and all healthy upstreams at once, or to every upstream if all is set.
+// Returns name of the first upstream that accepted it, error if any upstream failed to reply and none accepted it,
+// or neither if all upstreams rejected it.
+func (s *ProxyServer) submitBlock(params []string, all bool) (string, error) {
+	current := s.rpc()
+	upstreams := s.currentUpstreams().clients
+	results := make(chan submitResult, len(upstreams))
+	n := 0
+	for _, v := range upstreams {
+		if !all && v != current && v.Sick() {
+			continue
+		}
+		n++
+		go func(name string, submit func([]string) (bool, error)) {
+			ok, err := submit(params)
+			results <- submitResult{name: name, ok: ok, err: err}
+		}(v.Name, v.SubmitBlock)
+	}
+
+	var err error
+	rejected := false
+	for i := 0; i < n; i++ {
+		res := <-results
+		if res.ok {
+			return res.name, nil
+		}
+		if res.err != nil {
+			log.Printf("Block submission to %s failed: %v", res.name, res.err)
+			err = res.err
+		} else {
+			log.Printf("Block rejected by %s", res.name)
+			rejected = true
+		}
+	}
+	// Upstream that failed may still accept the block on retry
+	if err != nil {
+		return "", err
+	}
+	if rejected {
+		return "", nil
+	}
+	return "", errors.New("no upstream to submit block to")
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/yvasiyarov/go-metrics"
+)
+
+// Overload policies of share verification queue. Any share may solve a block,
+// so only waiting never loses a block to overload.
+const (
+	overloadWait   = "wait"
+	overloadReject = "reject"
+	overloadShed   = "shed"
+)
+
+type verifyJob struct {
+	seq    uint64
+	run    func()
+	queued time.Time
+	// Receives true once job ran, false if it was shed
+	done chan bool
+}
+
+// Runs PoW computations on a fixed number of workers. Jobs are queued per session
+// and taken round-robin, so a single flooding rig can't delay shares of others.
+type Verifier struct {
+	sync.Mutex
+	cond *sync.Cond
+	// Signalled when job leaves queue, submitters wait on it with overload policy "wait"
+	room          *sync.Cond
+	queues        map[interface{}][]*verifyJob
+	ring          []interface{}
+	pending       int
+	seq           uint64
+	workers       int
+	maxPending    int
+	maxPerSession int
+	overload      string
+
+	depth    metrics.Gauge
+	wait     metrics.Timer
+	compute  metrics.Timer
+	rejected metrics.Counter
+	dropped  metrics.Counter
+}
+
+func NewVerifier(cfg *ShareVerify) *Verifier {
+	v := &Verifier{
+		queues:        make(map[interface{}][]*verifyJob),
+		workers:       cfg.Workers,
+		maxPending:    cfg.QueueSize,
+		maxPerSession: cfg.MaxPerSession,
+		overload:      cfg.Overload,
+	}
+	if len(v.overload) == 0 {
+		v.overload = overloadWait
+	}
+	if v.workers <= 0 {
+		v.workers = runtime.NumCPU()
+	}
+	if v.maxPending <= 0 {
+		v.maxPending = 1024
+	}
+	v.cond = sync.NewCond(&v.Mutex)
+	v.room = sync.NewCond(&v.Mutex)
+	v.depth = metrics.GetOrRegisterGauge("proxy.verify.queue", metrics.DefaultRegistry)
+	v.wait = metrics.GetOrRegisterTimer("proxy.verify.wait", metrics.DefaultRegistry)
+	v.compute = metrics.GetOrRegisterTimer("proxy.verify.compute", metrics.DefaultRegistry)
+	v.rejected = metrics.GetOrRegisterCounter("proxy.verify.rejected", metrics.DefaultRegistry)
+	v.dropped = metrics.GetOrRegisterCounter("proxy.verify.shed", metrics.DefaultRegistry)
+	return v
+}
+
+func (v *Verifier) Start() {
+	for i := 0; i < v.workers; i++ {
+		go v.work()
+	}
+	log.Printf("Running %v share verification workers, queue of %v, %s on overload", v.workers, v.maxPending, v.overload)
+}
+
+// Queues job of session identified by key and waits for it to run.
+// With overload policy "wait" submitter waits for room in queue and job always runs,
+// otherwise returns false if job was refused or shed because of overload.
+func (v *Verifier) Do(key interface{}, run func()) bool {
+	job := &verifyJob{run: run, queued: time.Now(), done: make(chan bool, 1)}
+
+	v.Lock()
+	if v.overload == overloadWait {
+		for v.sessionFull(key) || v.pending >= v.maxPending {
+			v.room.Wait()
+		}
+	}
+	if v.sessionFull(key) {
+		v.Unlock()
+		v.rejected.Inc(1)
+		return false
+	}
+	if v.pending >= v.maxPending {
+		if v.overload != overloadShed {
+			v.Unlock()
+			v.rejected.Inc(1)
+			return false
+		}
+		v.shedOldest()
+	}
+	v.seq++
+	job.seq = v.seq
+	q, ok := v.queues[key]
+	if !ok {
+		v.ring = append(v.ring, key)
+	}
+	v.queues[key] = append(q, job)
+	v.pending++
+	v.depth.Update(int64(v.pending))
+	v.cond.Signal()
+	v.Unlock()
+
+	return <-job.done
+}
+
+func (v *Verifier) work() {
+	for {
+		v.Lock()
+		for v.pending == 0 {
+			v.cond.Wait()
+		}
+		job := v.next()
+		v.Unlock()
+
+		v.wait.UpdateSince(job.queued)
+		start := time.Now()
+		job.run()
+		v.compute.UpdateSince(start)
+		job.done <- true
+	}
+}
+
+func (v *Verifier) sessionFull(key interface{}) bool {
+	return v.maxPerSession > 0 && len(v.queues[key]) >= v.maxPerSession
+}
+
+// Pops job of the next session in turn, must be called with lock held.
+func (v *Verifier) next() *verifyJob {
+	key := v.ring[0]
+	v.ring = v.ring[1:]
+	q := v.queues[key]
+	job := q[0]
+	if len(q) > 1 {
+		v.queues[key] = q[1:]
+		v.ring = append(v.ring, key)
+	} else {
+		delete(v.queues, key)
+	}
+	v.pending--
+	v.depth.Update(int64(v.pending))
+	// Waiters may be held by either queue or session limit
+	v.room.Broadcast()
+	return job
+}
+
+// Drops the job waiting longest, must be called with lock held.
+func (v *Verifier) shedOldest() {
+	oldest := -1
+	for i, key := range v.ring {
+		if oldest < 0 || v.queues[key][0].seq < v.queues[v.ring[oldest]][0].seq {
+			oldest = i
+		}
+	}
+	key := v.ring[oldest]
+	q := v.queues[key]
+	job := q[0]
+	if len(q) > 1 {
+		v.queues[key] = q[1:]
+	} else {
+		delete(v.queues, key)
+		v.ring = append(v.ring[:oldest], v.ring[oldest+1:]...)
+	}
+	v.pending--
+	v.dropped.Inc(1)
+	job.done <- false
+}
+
+// Stratum and websocket miners queue per connection, HTTP miners per address.
+func (cs *Session) fairnessKey() interface{} {
+	if cs.conn != nil {
+		return cs
+	}
+	return cs.ip
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Starts verifier with single worker held by gate job until release is closed
+func newGatedVerifier(t *testing.T, cfg *ShareVerify) (*Verifier, chan struct{}) {
+	cfg.Workers = 1
+	v := NewVerifier(cfg)
+	v.Start()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go v.Do("gate", func() {
+		close(started)
+		<-release
+	})
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Gate job must start")
+	}
+	return v, release
+}
+
+func waitPending(t *testing.T, v *Verifier, n int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		v.Lock()
+		pending := v.pending
+		v.Unlock()
+		if pending == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Queue must hold %v jobs", n)
+}
+
+type verifyResult struct {
+	name string
+	ok   bool
+}
+
+// Queues job in background once previous jobs are queued, so order of queueing is fixed
+func queueJob(t *testing.T, v *Verifier, key, name string, order chan<- string, results chan<- verifyResult) {
+	v.Lock()
+	n := v.pending
+	v.Unlock()
+	go func() {
+		ok := v.Do(key, func() { order <- name })
+		results <- verifyResult{name, ok}
+	}()
+	waitPending(t, v, n+1)
+}
+
+func TestVerifierRoundRobin(t *testing.T) {
+	v, release := newGatedVerifier(t, &ShareVerify{QueueSize: 16})
+	order := make(chan string, 8)
+	results := make(chan verifyResult, 8)
+	queueJob(t, v, "a", "a1", order, results)
+	queueJob(t, v, "a", "a2", order, results)
+	queueJob(t, v, "a", "a3", order, results)
+	queueJob(t, v, "b", "b1", order, results)
+	queueJob(t, v, "c", "c1", order, results)
+	close(release)
+
+	// Flooding session must not delay the others
+	expected := []string{"a1", "b1", "c1", "a2", "a3"}
+	for _, name := range expected {
+		if got := <-order; got != name {
+			t.Errorf("Expected %v to run, got %v", name, got)
+		}
+	}
+	for range expected {
+		if r := <-results; !r.ok {
+			t.Errorf("Job %v must run", r.name)
+		}
+	}
+}
+
+func TestVerifierReject(t *testing.T) {
+	v, release := newGatedVerifier(t, &ShareVerify{QueueSize: 2, MaxPerSession: 1, Overload: overloadReject})
+	order := make(chan string, 8)
+	results := make(chan verifyResult, 8)
+	queueJob(t, v, "a", "a1", order, results)
+
+	if v.Do("a", func() { t.Error("Job over session limit must not run") }) {
+		t.Error("Job over session limit must be rejected")
+	}
+	queueJob(t, v, "b", "b1", order, results)
+	if v.Do("c", func() { t.Error("Job over queue size must not run") }) {
+		t.Error("Job over queue size must be rejected")
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if r := <-results; !r.ok {
+			t.Errorf("Queued job %v must run", r.name)
+		}
+	}
+}
+
+func TestVerifierShed(t *testing.T) {
+	v, release := newGatedVerifier(t, &ShareVerify{QueueSize: 2, Overload: overloadShed})
+	order := make(chan string, 8)
+	results := make(chan verifyResult, 8)
+	queueJob(t, v, "a", "a1", order, results)
+	queueJob(t, v, "b", "b1", order, results)
+
+	// Oldest queued job is dropped to make room
+	go func() {
+		ok := v.Do("c", func() { order <- "c1" })
+		results <- verifyResult{"c1", ok}
+	}()
+	select {
+	case r := <-results:
+		if r.name != "a1" || r.ok {
+			t.Errorf("Oldest job must be shed, got %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Oldest job must be shed")
+	}
+	waitPending(t, v, 2)
+	close(release)
+
+	for _, name := range []string{"b1", "c1"} {
+		if got := <-order; got != name {
+			t.Errorf("Expected %v to run, got %v", name, got)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if r := <-results; !r.ok {
+			t.Errorf("Job %v must run", r.name)
+		}
+	}
+}
+
+func TestVerifierWait(t *testing.T) {
+	v, release := newGatedVerifier(t, &ShareVerify{QueueSize: 1, MaxPerSession: 1})
+	order := make(chan string, 8)
+	results := make(chan verifyResult, 8)
+	queueJob(t, v, "a", "a1", order, results)
+
+	// Both over queue size and over session limit, submitters wait instead of losing shares
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			ok := v.Do(key, func() { order <- key + "2" })
+			results <- verifyResult{key + "2", ok}
+		}(key)
+	}
+	select {
+	case r := <-results:
+		t.Fatalf("Submitter must wait for room, got %+v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < 3; i++ {
+		if r := <-results; !r.ok {
+			t.Errorf("Job %v must run", r.name)
+		}
+	}
+	if len(order) != 3 {
+		t.Errorf("All jobs must run, got %v", len(order))
+	}
+}
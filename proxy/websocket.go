@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/sero-cash/mine-pool/util"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  MaxReqSize,
+	WriteBufferSize: MaxReqSize,
+	// Browser miners are served from any site
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Sends every encoded JSON message as a single text frame
+type wsWriter struct {
+	conn *websocket.Conn
+}
+
+func (w *wsWriter) Write(p []byte) (int, error) {
+	err := w.conn.WriteMessage(websocket.TextMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *ProxyServer) ListenWebSocket() {
+	timeout := util.MustParseDuration(s.config.Proxy.WebSocket.Timeout)
+	accept := make(chan struct{}, s.config.Proxy.WebSocket.MaxConn)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		ip := s.remoteAddr(r)
+		if s.policy.IsBanned(ip) || !s.policy.AllowConnection(ip) || !s.policy.ApplyLimitPolicy(ip) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		select {
+		case accept <- struct{}{}:
+		default:
+			http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-accept }()
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("WebSocket upgrade failed for %s: %v", ip, err)
+			return
+		}
+		defer conn.Close()
+		conn.SetReadLimit(MaxReqSize)
+
+		cs := &Session{conn: conn.UnderlyingConn(), ip: ip, timeout: timeout, id: s.nextSessionId(), connectedAt: util.MakeTimestamp(), agent: r.UserAgent()}
+		cs.enc = json.NewEncoder(&wsWriter{conn: conn})
+		err = s.handleWSClient(cs, conn)
+		s.removeSession(cs)
+		if err != nil {
+			log.Printf("WebSocket client %s disconnected: %v", ip, err)
+		}
+	}
+
+	log.Printf("WebSocket mining listening on %s", s.config.Proxy.WebSocket.Listen)
+	l, err := net.Listen("tcp", s.config.Proxy.WebSocket.Listen)
+	if err != nil {
+		log.Fatalf("Failed to start WebSocket listener: %v", err)
+	}
+	if s.config.Proxy.ProxyProtocol.WebSocket {
+		l = newProxyProtoListener(l, &s.config.Proxy.ProxyProtocol)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(handler)}
+	if !s.trackListener(srv) {
+		return
+	}
+	err = srv.Serve(l)
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Failed to start WebSocket listener: %v", err)
+	}
+}
+
+// Same message set as stratum, one JSON request per frame.
+func (s *ProxyServer) handleWSClient(cs *Session, conn *websocket.Conn) error {
+	cs.setDeadline()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err == websocket.ErrReadLimit {
+			log.Printf("Socket flood detected from %s", cs.ip)
+			s.policy.BanClient(cs.ip)
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		if len(data) > 1 {
+			var req StratumReq
+			err = json.Unmarshal(data, &req)
+			if err != nil {
+				s.policy.ApplyMalformedPolicy(cs.ip)
+				log.Printf("Malformed websocket request from %s: %v", cs.ip, err)
+				return err
+			}
+			cs.setDeadline()
+			err = cs.handleTCPMessage(s, &req)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/sero-cash/mine-pool/rpc"
+	"github.com/sero-cash/mine-pool/util"
+)
+
+const resubscribeDelay = 5 * time.Second
+
+// Template is still polled this often while new heads subscription delivers work
+const subscribedRefreshInterval = 30 * time.Second
+
+// Keeps new heads subscription on the active upstream, template polling slows down while it delivers heads.
+func (s *ProxyServer) subscribeWork() {
+	for {
+		if s.isStopping() {
+			return
+		}
+		set := s.currentUpstreams()
+		upstream := set.config[s.upstreamIndex(set)]
+		if len(upstream.Ws) == 0 {
+			time.Sleep(resubscribeDelay)
+			continue
+		}
+		sub := rpc.NewHeadSubscription(upstream.Name, upstream.Ws)
+		s.headSubMu.Lock()
+		s.headSub = sub
+		s.headSubMu.Unlock()
+
+		log.Printf("Subscribing to new heads on %s", upstream.Name)
+		err := sub.Run(util.MustParseDuration(upstream.Timeout), func(number string) {
+			if atomic.CompareAndSwapInt32(&s.subscribed, 0, 1) {
+				log.Printf("Receiving new heads from %s, block polling slowed down", upstream.Name)
+			}
+			s.fetchBlockTemplate()
+		})
+		if atomic.SwapInt32(&s.subscribed, 0) == 1 {
+			log.Printf("New heads subscription on %s dropped, falling back to polling: %v", upstream.Name, err)
+		} else {
+			log.Printf("Failed to subscribe to new heads on %s: %v", upstream.Name, err)
+		}
+		time.Sleep(resubscribeDelay)
+	}
+}
+
+// Drops current subscription, so it is made again on the active upstream.
+func (s *ProxyServer) resubscribeWork() {
+	s.headSubMu.Lock()
+	defer s.headSubMu.Unlock()
+	if s.headSub != nil {
+		s.headSub.Close()
+	}
+}
+
+func (s *ProxyServer) isSubscribed() bool {
+	return atomic.LoadInt32(&s.subscribed) == 1
+}
@@ -0,0 +1,41 @@
+// +build go1.9
+
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/sero-cash/mine-pool/storage"
+)
+
+// Usage: mine-pool release <login> [config.json]
+// Releases payouts held for suspected block withholding, login is not held automatically again.
+func runRelease(args []string) {
+	flags := flag.NewFlagSet("release", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		log.Fatal("Usage: mine-pool release <login> [config.json]")
+	}
+	login := flags.Arg(0)
+	configFileName := "config.json"
+	if flags.NArg() > 1 {
+		configFileName = flags.Arg(1)
+	}
+	readConfig(&cfg, configFileName)
+
+	backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+	if _, err := backend.Check(); err != nil {
+		log.Fatalf("Can't establish connection to backend: %v", err)
+	}
+	existed, err := backend.ReleasePayouts(login)
+	if err != nil {
+		log.Fatalf("Failed to release payouts of %v: %v", login, err)
+	}
+	if existed {
+		log.Printf("Released payouts of %v", login)
+	} else {
+		log.Printf("Payouts of %v were not held, login will not be held automatically", login)
+	}
+}
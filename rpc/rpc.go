@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/btcsuite/btcutil/base58"
 
@@ -27,6 +28,9 @@ type RPCClient struct {
 	sickRate    int
 	successRate int
 	client      *http.Client
+	// Chain tip and round trip time seen on the last status check
+	height  int64
+	latency time.Duration
 }
 
 type GetBlockReply struct {
@@ -453,6 +457,31 @@ func (r *RPCClient) Check() bool {
 	return !r.Sick()
 }
 
+// Checks node like Check and also measures its chain tip and latency.
+func (r *RPCClient) CheckStatus() bool {
+	start := time.Now()
+	ok := r.Check()
+	latency := time.Since(start)
+	if !ok {
+		return false
+	}
+	height, err := r.GetBlockNumber()
+	if err != nil {
+		return false
+	}
+	r.Lock()
+	r.height = height
+	r.latency = latency
+	r.Unlock()
+	return true
+}
+
+func (r *RPCClient) Status() (int64, time.Duration) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.height, r.latency
+}
+
 func (r *RPCClient) Sick() bool {
 	r.RLock()
 	defer r.RUnlock()
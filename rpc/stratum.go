@@ -0,0 +1,202 @@
+package rpc
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sero-cash/mine-pool/util"
+)
+
+// Stratum connection to an upstream pool, used when this pool runs as a farm proxy
+type StratumClient struct {
+	sync.Mutex
+	Url     string
+	Name    string
+	login   string
+	worker  string
+	timeout time.Duration
+
+	conn      net.Conn
+	enc       *json.Encoder
+	seq       int64
+	replies   map[int64]chan *stratumResp
+	job       atomic.Value
+	connected int32
+}
+
+type stratumReq struct {
+	Id     int64       `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+	Worker string      `json:"worker,omitempty"`
+}
+
+type stratumResp struct {
+	Id     int64                  `json:"id"`
+	Result *json.RawMessage       `json:"result"`
+	Error  map[string]interface{} `json:"error"`
+}
+
+const stratumReconnectDelay = 5 * time.Second
+
+func NewStratumClient(name, url, login, worker, timeout string) *StratumClient {
+	c := &StratumClient{Name: name, Url: url, login: login, worker: worker}
+	c.timeout = util.MustParseDuration(timeout)
+	return c
+}
+
+// Keeps connection to the pool, onJob is called every time pool sends new job.
+func (c *StratumClient) Start(onJob func()) {
+	go func() {
+		for {
+			err := c.run(onJob)
+			atomic.StoreInt32(&c.connected, 0)
+			// Job of the old session is not valid on the new one, first job after reconnect is always taken
+			c.job.Store([]string(nil))
+			log.Printf("Upstream pool %s disconnected: %v", c.Name, err)
+			time.Sleep(stratumReconnectDelay)
+		}
+	}()
+}
+
+func (c *StratumClient) run(onJob func()) error {
+	conn, err := net.DialTimeout("tcp", c.Url, c.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	c.Lock()
+	c.conn = conn
+	c.enc = json.NewEncoder(conn)
+	c.replies = make(map[int64]chan *stratumResp)
+	c.Unlock()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.read(onJob)
+	}()
+
+	ok, err := c.call("sero_submitLogin", []string{c.login})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("login %s rejected", c.login)
+	}
+	log.Printf("Logged in to upstream pool %s as %s", c.Name, c.login)
+	atomic.StoreInt32(&c.connected, 1)
+
+	// Reply to getWork is a job too
+	if _, err = c.send("sero_getWork", []string{}); err != nil {
+		return err
+	}
+	return <-errs
+}
+
+func (c *StratumClient) read(onJob func()) error {
+	reader := bufio.NewReader(c.conn)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout * 10))
+		data, err := reader.ReadBytes('\n')
+		if err != nil {
+			c.conn.Close()
+			return err
+		}
+		var resp stratumResp
+		if err = json.Unmarshal(data, &resp); err != nil {
+			c.conn.Close()
+			return fmt.Errorf("malformed message: %v", err)
+		}
+
+		c.Lock()
+		reply, ok := c.replies[resp.Id]
+		delete(c.replies, resp.Id)
+		c.Unlock()
+		if ok {
+			reply <- &resp
+			continue
+		}
+
+		var job []string
+		if resp.Error != nil || resp.Result == nil || json.Unmarshal(*resp.Result, &job) != nil || len(job) < 4 {
+			continue
+		}
+		if current := c.Job(); current == nil || current[0] != job[0] {
+			c.job.Store(job)
+			onJob()
+		}
+	}
+}
+
+func (c *StratumClient) send(method string, params interface{}) (int64, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.enc == nil {
+		return 0, errors.New("not connected")
+	}
+	c.seq++
+	req := stratumReq{Id: c.seq, Method: method, Params: params, Worker: c.worker}
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.seq, c.enc.Encode(&req)
+}
+
+// Sends request and waits for boolean reply.
+func (c *StratumClient) call(method string, params interface{}) (bool, error) {
+	reply := make(chan *stratumResp, 1)
+	c.Lock()
+	c.seq++
+	id := c.seq
+	c.replies[id] = reply
+	req := stratumReq{Id: id, Method: method, Params: params, Worker: c.worker}
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	err := c.enc.Encode(&req)
+	c.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-reply:
+		if resp.Error != nil {
+			return false, fmt.Errorf("%v", resp.Error["message"])
+		}
+		var ok bool
+		if resp.Result != nil {
+			err = json.Unmarshal(*resp.Result, &ok)
+		}
+		return ok, err
+	case <-timer.C:
+		c.Lock()
+		delete(c.replies, id)
+		c.Unlock()
+		return false, errors.New("request timed out")
+	}
+}
+
+// Returns last job as [header, seed, target, height] or nil if there is no job yet.
+func (c *StratumClient) Job() []string {
+	job, _ := c.job.Load().([]string)
+	return job
+}
+
+// Forwards solution found by one of local miners, params are [nonce, header, mixDigest].
+func (c *StratumClient) SubmitWork(params []string) (bool, error) {
+	if !c.Connected() {
+		return false, errors.New("not connected")
+	}
+	return c.call("sero_submitWork", params)
+}
+
+func (c *StratumClient) Connected() bool {
+	return atomic.LoadInt32(&c.connected) == 1
+}
@@ -0,0 +1,119 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket subscription to new chain heads of a node
+type HeadSubscription struct {
+	sync.Mutex
+	Url  string
+	Name string
+	conn *websocket.Conn
+}
+
+type subscriptionNotification struct {
+	Method string `json:"method"`
+	Params struct {
+		Subscription string          `json:"subscription"`
+		Result       json.RawMessage `json:"result"`
+	} `json:"params"`
+}
+
+type headNotification struct {
+	Number string `json:"number"`
+	Hash   string `json:"hash"`
+}
+
+func NewHeadSubscription(name, url string) *HeadSubscription {
+	return &HeadSubscription{Name: name, Url: url}
+}
+
+// Blocks until subscription fails or is closed, calls onHead with hex number of every new head.
+func (s *HeadSubscription) Run(timeout time.Duration, onHead func(number string)) error {
+	dialer := websocket.Dialer{HandshakeTimeout: timeout}
+	conn, _, err := dialer.Dial(s.Url, nil)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.conn = conn
+	s.Unlock()
+	defer s.Close()
+
+	req := map[string]interface{}{"jsonrpc": "2.0", "id": 0, "method": "sero_subscribe", "params": []string{"newHeads"}}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err = conn.WriteJSON(req); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	var resp JSONRpcResp
+	if err = conn.ReadJSON(&resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%v", resp.Error["message"])
+	}
+	if resp.Result == nil {
+		return errors.New("empty subscription id")
+	}
+	var id string
+	if err = json.Unmarshal(*resp.Result, &id); err != nil {
+		return err
+	}
+	// Node is pinged every timeout, half-open connection fails once no pong or head arrived for two of them
+	alive := func() { conn.SetReadDeadline(time.Now().Add(2 * timeout)) }
+	alive()
+	conn.SetPongHandler(func(string) error {
+		alive()
+		return nil
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(timeout)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		var msg subscriptionNotification
+		if err = conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		alive()
+		if msg.Method != "sero_subscription" || msg.Params.Subscription != id {
+			continue
+		}
+		var head headNotification
+		if err = json.Unmarshal(msg.Params.Result, &head); err != nil {
+			return fmt.Errorf("malformed head notification: %v", err)
+		}
+		onHead(head.Number)
+	}
+}
+
+// Interrupts running subscription.
+func (s *HeadSubscription) Close() {
+	s.Lock()
+	defer s.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/sero-cash/mine-pool/util"
+)
+
+// IP ban shared by all pool instances, timestamps are in milliseconds
+type Ban struct {
+	IP        string `json:"ip"`
+	Reason    string `json:"reason"`
+	BannedAt  int64  `json:"bannedAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// Stores ban and announces it to other instances.
+func (r *RedisClient) WriteBan(ban *Ban) error {
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		tx.HSet(r.formatKey("bans"), ban.IP, string(data))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = r.pubsubNode().Publish(r.formatKey("bans"), string(data)).Err()
+	if err != nil {
+		r.nextPubsubNode()
+	}
+	return err
+}
+
+// Returns bans in effect, expired ones are removed.
+func (r *RedisClient) GetBans() ([]*Ban, error) {
+	tx, err := r.multi()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	stored, err := tx.HGetAllMap(r.formatKey("bans")).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := util.MakeTimestamp()
+	var bans []*Ban
+	var expired []string
+	for ip, data := range stored {
+		var ban Ban
+		if err := json.Unmarshal([]byte(data), &ban); err != nil || ban.ExpiresAt <= now {
+			expired = append(expired, ip)
+			continue
+		}
+		bans = append(bans, &ban)
+	}
+	if len(expired) > 0 {
+		_, err = tx.Exec(func() error {
+			tx.HDel(r.formatKey("bans"), expired...)
+			return nil
+		})
+	}
+	return bans, err
+}
+
+// Delivers bans announced by any instance, blocks until subscription fails or quit is closed.
+// Returns nil if it was stopped by quit.
+func (r *RedisClient) SubscribeBans(handler func(*Ban), quit <-chan struct{}) error {
+	pubsub, err := r.pubsubNode().Subscribe(r.formatKey("bans"))
+	if err != nil {
+		r.nextPubsubNode()
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-quit:
+		case <-done:
+		}
+		pubsub.Close()
+	}()
+
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			select {
+			case <-quit:
+				return nil
+			default:
+			}
+			r.nextPubsubNode()
+			return err
+		}
+		var ban Ban
+		if err := json.Unmarshal([]byte(msg.Payload), &ban); err != nil {
+			log.Printf("Malformed ban announcement: %v", err)
+			continue
+		}
+		handler(&ban)
+	}
+}
+
+func (r *RedisClient) pubsubNode() *redis.Client {
+	return r.pubsub[atomic.LoadUint32(&r.pubsubNext)%uint32(len(r.pubsub))]
+}
+
+func (r *RedisClient) nextPubsubNode() {
+	atomic.AddUint32(&r.pubsubNext, 1)
+}
@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+type PostgresConfig struct {
+	Enabled      bool   `json:"enabled"`
+	Url          string `json:"url"`
+	MaxOpenConns int    `json:"maxOpenConns"`
+	MaxIdleConns int    `json:"maxIdleConns"`
+}
+
+type PostgresClient struct {
+	db *sql.DB
+}
+
+// Ordered list of schema migrations, applied once each and recorded in schema_migrations.
+// Never edit an entry that may already be deployed, append a new one instead.
+var postgresMigrations = []string{
+	`CREATE TABLE blocks (
+		height       BIGINT NOT NULL,
+		hash         TEXT NOT NULL,
+		nonce        TEXT NOT NULL,
+		timestamp    BIGINT NOT NULL,
+		difficulty   BIGINT NOT NULL,
+		total_shares BIGINT NOT NULL,
+		uncle_height BIGINT NOT NULL DEFAULT 0,
+		orphan       BOOLEAN NOT NULL DEFAULT FALSE,
+		reward       NUMERIC(78, 0) NOT NULL DEFAULT 0,
+		PRIMARY KEY (height, hash, nonce)
+	);
+	CREATE INDEX blocks_timestamp_idx ON blocks (timestamp);`,
+
+	`CREATE TABLE credits (
+		height BIGINT NOT NULL,
+		hash   TEXT NOT NULL,
+		login  TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		PRIMARY KEY (height, hash, login)
+	);
+	CREATE INDEX credits_login_idx ON credits (login, height);`,
+
+	`CREATE TABLE payments (
+		tx_hash   TEXT NOT NULL,
+		login     TEXT NOT NULL,
+		amount    BIGINT NOT NULL,
+		timestamp BIGINT NOT NULL,
+		PRIMARY KEY (tx_hash, login)
+	);
+	CREATE INDEX payments_timestamp_idx ON payments (timestamp);
+	CREATE INDEX payments_login_idx ON payments (login, timestamp);`,
+
+	`CREATE TABLE hashrate_daily (
+		day          DATE NOT NULL,
+		login        TEXT NOT NULL,
+		samples      BIGINT NOT NULL,
+		hashrate_sum BIGINT NOT NULL,
+		hashrate_max BIGINT NOT NULL,
+		PRIMARY KEY (day, login)
+	);`,
+}
+
+func NewPostgresClient(cfg *PostgresConfig) (*PostgresClient, error) {
+	db, err := sql.Open("postgres", cfg.Url)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	return &PostgresClient{db: db}, nil
+}
+
+func (p *PostgresClient) Check() error {
+	return p.db.Ping()
+}
+
+func (p *PostgresClient) Close() error {
+	return p.db.Close()
+}
+
+// Applies all pending schema migrations, each one in its own transaction.
+func (p *PostgresClient) Migrate() error {
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INT PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	var current int
+	err = p.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+	for i := current; i < len(postgresMigrations); i++ {
+		version := i + 1
+		tx, err := p.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(postgresMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration %v failed: %v", version, err)
+		}
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)`, version, time.Now().Unix())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Applied PostgreSQL schema migration %v", version)
+	}
+	return nil
+}
+
+func (p *PostgresClient) LastBlockHeight() (int64, error) {
+	var height int64
+	err := p.db.QueryRow(`SELECT COALESCE(MAX(height), 0) FROM blocks`).Scan(&height)
+	return height, err
+}
+
+func (p *PostgresClient) HasBlock(block *BlockData) (bool, error) {
+	var exists bool
+	err := p.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM blocks WHERE height = $1 AND hash = $2 AND nonce = $3)`,
+		block.Height, block.Hash, block.Nonce).Scan(&exists)
+	return exists, err
+}
+
+func (p *PostgresClient) LastPaymentTimestamp() (int64, error) {
+	var ts int64
+	err := p.db.QueryRow(`SELECT COALESCE(MAX(timestamp), 0) FROM payments`).Scan(&ts)
+	return ts, err
+}
+
+// Inserts matured block along with its credits, already archived rows are left untouched.
+func (p *PostgresClient) WriteBlock(block *BlockData, credits map[string]int64) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	reward := block.RewardString
+	if len(reward) == 0 {
+		reward = "0"
+	}
+	_, err = tx.Exec(`INSERT INTO blocks (height, hash, nonce, timestamp, difficulty, total_shares, uncle_height, orphan, reward)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT DO NOTHING`,
+		block.Height, block.Hash, block.Nonce, block.Timestamp, block.Difficulty, block.TotalShares,
+		block.UncleHeight, block.Orphan, reward)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for login, amount := range credits {
+		_, err = tx.Exec(`INSERT INTO credits (height, hash, login, amount) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`,
+			block.Height, block.Hash, login, amount)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresClient) WritePayments(payments []*Payment) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, v := range payments {
+		_, err = tx.Exec(`INSERT INTO payments (tx_hash, login, amount, timestamp) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`,
+			v.TxHash, v.Address, v.Amount, v.Timestamp)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Accumulates hashrate sample into daily summary, empty login stands for the whole pool.
+func (p *PostgresClient) WriteHashrateSamples(day time.Time, samples map[string]int64) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	date := day.UTC().Format("2006-01-02")
+	for login, hashrate := range samples {
+		_, err = tx.Exec(`INSERT INTO hashrate_daily (day, login, samples, hashrate_sum, hashrate_max) VALUES ($1, $2, 1, $3, $3)
+			ON CONFLICT (day, login) DO UPDATE SET
+				samples = hashrate_daily.samples + 1,
+				hashrate_sum = hashrate_daily.hashrate_sum + EXCLUDED.hashrate_sum,
+				hashrate_max = GREATEST(hashrate_daily.hashrate_max, EXCLUDED.hashrate_max)`,
+			date, login, hashrate)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresClient) GetBlocks(offset, limit int64) ([]*BlockData, int64, error) {
+	rows, err := p.db.Query(`SELECT height, hash, nonce, timestamp, difficulty, total_shares, uncle_height, orphan, reward::TEXT
+		FROM blocks ORDER BY height DESC LIMIT $1 OFFSET $2`, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var result []*BlockData
+	for rows.Next() {
+		block := BlockData{}
+		err = rows.Scan(&block.Height, &block.Hash, &block.Nonce, &block.Timestamp, &block.Difficulty,
+			&block.TotalShares, &block.UncleHeight, &block.Orphan, &block.RewardString)
+		if err != nil {
+			return nil, 0, err
+		}
+		block.Uncle = block.UncleHeight > 0
+		block.RoundHeight = block.Height
+		block.Reward, _ = new(big.Int).SetString(block.RewardString, 10)
+		result = append(result, &block)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	var total int64
+	err = p.db.QueryRow(`SELECT COUNT(*) FROM blocks`).Scan(&total)
+	return result, total, err
+}
+
+// Empty login selects payments of the whole pool.
+func (p *PostgresClient) GetPayments(login string, offset, limit int64) ([]map[string]interface{}, int64, error) {
+	rows, err := p.db.Query(`SELECT tx_hash, login, amount, timestamp FROM payments
+		WHERE $1 = '' OR login = $1 ORDER BY timestamp DESC LIMIT $2 OFFSET $3`, login, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	result, err := convertPaymentRows(rows, len(login) == 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int64
+	err = p.db.QueryRow(`SELECT COUNT(*) FROM payments WHERE $1 = '' OR login = $1`, login).Scan(&total)
+	return result, total, err
+}
+
+// Returns pool payments between two unix timestamps, inclusive.
+func (p *PostgresClient) GetPaymentsBetween(from, to int64) ([]map[string]interface{}, error) {
+	rows, err := p.db.Query(`SELECT tx_hash, login, amount, timestamp FROM payments
+		WHERE timestamp >= $1 AND timestamp <= $2 ORDER BY timestamp`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return convertPaymentRows(rows, true)
+}
+
+func (p *PostgresClient) GetCredits(login string, offset, limit int64) ([]map[string]interface{}, int64, error) {
+	rows, err := p.db.Query(`SELECT c.height, c.hash, c.amount, b.timestamp FROM credits c
+		LEFT JOIN blocks b ON b.height = c.height AND b.hash = c.hash
+		WHERE c.login = $1 ORDER BY c.height DESC LIMIT $2 OFFSET $3`, login, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var result []map[string]interface{}
+	for rows.Next() {
+		var height, amount int64
+		var hash string
+		var ts sql.NullInt64
+		if err = rows.Scan(&height, &hash, &amount, &ts); err != nil {
+			return nil, 0, err
+		}
+		result = append(result, map[string]interface{}{
+			"height": height, "hash": hash, "amount": amount, "timestamp": ts.Int64,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	var total int64
+	err = p.db.QueryRow(`SELECT COUNT(*) FROM credits WHERE login = $1`, login).Scan(&total)
+	return result, total, err
+}
+
+// Returns average and peak daily hashrate for the last days, empty login stands for the whole pool.
+func (p *PostgresClient) GetDailyHashrate(login string, days int64) ([]map[string]interface{}, error) {
+	rows, err := p.db.Query(`SELECT day::TEXT, hashrate_sum / samples, hashrate_max FROM hashrate_daily
+		WHERE login = $1 AND day > CURRENT_DATE - $2::INT ORDER BY day`, login, days)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []map[string]interface{}
+	for rows.Next() {
+		var day string
+		var avg, max int64
+		if err = rows.Scan(&day, &avg, &max); err != nil {
+			return nil, err
+		}
+		result = append(result, map[string]interface{}{"day": day, "hashrate": avg, "hashrateMax": max})
+	}
+	return result, rows.Err()
+}
+
+func convertPaymentRows(rows *sql.Rows, withAddress bool) ([]map[string]interface{}, error) {
+	defer rows.Close()
+
+	var result []map[string]interface{}
+	for rows.Next() {
+		var txHash, login string
+		var amount, ts int64
+		if err := rows.Scan(&txHash, &login, &amount, &ts); err != nil {
+			return nil, err
+		}
+		tx := map[string]interface{}{"tx": txHash, "amount": amount, "timestamp": ts}
+		if withAddress {
+			tx["address"] = login
+		}
+		result = append(result, tx)
+	}
+	return result, rows.Err()
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"fmt"
+	"math"
 	"math/big"
 	"strconv"
 	"strings"
@@ -13,15 +14,64 @@ import (
 )
 
 type Config struct {
-	Endpoint string `json:"endpoint"`
-	Password string `json:"password"`
-	Database int64  `json:"database"`
-	PoolSize int    `json:"poolSize"`
+	Endpoint string         `json:"endpoint"`
+	Password string         `json:"password"`
+	Database int64          `json:"database"`
+	PoolSize int            `json:"poolSize"`
+	Sentinel SentinelConfig `json:"sentinel"`
+	Cluster  ClusterConfig  `json:"cluster"`
+}
+
+type SentinelConfig struct {
+	Enabled    bool     `json:"enabled"`
+	MasterName string   `json:"masterName"`
+	Addrs      []string `json:"addrs"`
+}
+
+type ClusterConfig struct {
+	Enabled bool     `json:"enabled"`
+	Addrs   []string `json:"addrs"`
+}
+
+// Commands shared by single node, sentinel and cluster clients
+type redisCmdable interface {
+	Ping() *redis.StatusCmd
+	BgSave() *redis.StatusCmd
+	Del(keys ...string) *redis.IntCmd
+	Exists(key string) *redis.BoolCmd
+	Keys(pattern string) *redis.StringSliceCmd
+	Rename(key, newkey string) *redis.StatusCmd
+	Scan(cursor int64, match string, count int64) *redis.ScanCmd
+	Get(key string) *redis.StringCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	HGet(key, field string) *redis.StringCmd
+	HGetAllMap(key string) *redis.StringStringMapCmd
+	HIncrBy(key, field string, incr int64) *redis.IntCmd
+	HLen(key string) *redis.IntCmd
+	HMSetMap(key string, fields map[string]string) *redis.StatusCmd
+	HSet(key, field, value string) *redis.BoolCmd
+	SMembers(key string) *redis.StringSliceCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+	ZCard(key string) *redis.IntCmd
+	ZRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd
+	ZRangeByScoreWithScores(key string, opt redis.ZRangeByScore) *redis.ZSliceCmd
+	ZRank(key, member string) *redis.IntCmd
+	ZRemRangeByScore(key, min, max string) *redis.IntCmd
+	ZRevRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd
+	Watch(keys ...string) (*redis.Multi, error)
+	Close() error
 }
 
 type RedisClient struct {
-	client *redis.Client
+	client redisCmdable
+	// Set unless running against Redis Cluster
+	node   *redis.Client
 	prefix string
+	// Pub/sub connections, cluster node relays messages to the whole cluster,
+	// so any of them will do and the next one is tried when current fails
+	pubsub     []*redis.Client
+	pubsubNext uint32
 }
 
 type BlockData struct {
@@ -73,33 +123,135 @@ type Miner struct {
 	startedAt int64
 }
 
+// Valid block solution which was not accepted by any upstream
+type FailedBlock struct {
+	Height     int64  `json:"height"`
+	Timestamp  int64  `json:"timestamp"`
+	Difficulty int64  `json:"difficulty"`
+	Login      string `json:"login"`
+	Worker     string `json:"worker"`
+	Nonce      string `json:"nonce"`
+	PowHash    string `json:"powHash"`
+	MixDigest  string `json:"mixDigest"`
+}
+
+// Valid share waiting to be written in a batch
+type Share struct {
+	Login      string
+	Id         string
+	Difficulty int64
+	// Difficulty of block the share was submitted for
+	NetworkDifficulty int64
+	// Submission time in milliseconds
+	Timestamp int64
+}
+
 type Worker struct {
 	Miner
 	TotalHR int64 `json:"hr2"`
+	// Shares within large window
+	Valid     int64 `json:"valid"`
+	Stale     int64 `json:"stale"`
+	Invalid   int64 `json:"invalid"`
+	Duplicate int64 `json:"duplicate"`
+	// Hashrate reported by mining software and how far effective one is below it, in percent
+	ReportedHR int64   `json:"reportedHr,omitempty"`
+	Divergence float64 `json:"divergence,omitempty"`
 }
 
 func NewRedisClient(cfg *Config, prefix string) *RedisClient {
-	client := redis.NewClient(&redis.Options{
-		Addr:     cfg.Endpoint,
-		Password: cfg.Password,
-		DB:       cfg.Database,
-		PoolSize: cfg.PoolSize,
-	})
-	return &RedisClient{client: client, prefix: prefix}
+	if cfg.Cluster.Enabled {
+		client := redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    cfg.Cluster.Addrs,
+			Password: cfg.Password,
+			PoolSize: cfg.PoolSize,
+		})
+		// Hash tag pins all pool keys to a single slot, so transactions never span nodes.
+		// Cluster mode is single-slot only, data is not sharded and one master serves all of it.
+		r := &RedisClient{client: client, prefix: "{" + prefix + "}"}
+		for _, addr := range cfg.Cluster.Addrs {
+			r.pubsub = append(r.pubsub, redis.NewClient(&redis.Options{Addr: addr, Password: cfg.Password, PoolSize: 2}))
+		}
+		return r
+	}
+	var client *redis.Client
+	if cfg.Sentinel.Enabled {
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    cfg.Sentinel.MasterName,
+			SentinelAddrs: cfg.Sentinel.Addrs,
+			Password:      cfg.Password,
+			DB:            cfg.Database,
+			PoolSize:      cfg.PoolSize,
+		})
+	} else {
+		client = redis.NewClient(&redis.Options{
+			Addr:     cfg.Endpoint,
+			Password: cfg.Password,
+			DB:       cfg.Database,
+			PoolSize: cfg.PoolSize,
+		})
+	}
+	return &RedisClient{client: client, node: client, prefix: prefix, pubsub: []*redis.Client{client}}
 }
 
+// Returns plain client of single node and Sentinel setups, nil in cluster mode where commands
+// must go through cluster client to follow slot migrations.
 func (r *RedisClient) Client() *redis.Client {
-	return r.client
+	return r.node
 }
 
 func (r *RedisClient) Check() (string, error) {
 	return r.client.Ping().Result()
 }
 
+// Closes connection pool, must be called when nothing writes to backend anymore.
+func (r *RedisClient) Close() error {
+	if r.node == nil {
+		for _, c := range r.pubsub {
+			c.Close()
+		}
+	}
+	return r.client.Close()
+}
+
 func (r *RedisClient) BgSave() (string, error) {
+	if r.node == nil {
+		tx, err := r.multi()
+		if err != nil {
+			return "", err
+		}
+		defer tx.Close()
+		return tx.BgSave().Result()
+	}
 	return r.client.BgSave().Result()
 }
 
+// Starts a transaction. In cluster mode it is bound to the node serving pool keys slot.
+func (r *RedisClient) multi() (*redis.Multi, error) {
+	if r.node != nil {
+		return r.node.Multi(), nil
+	}
+	// Watching any key with pool hash tag routes connection to the right node
+	tx, err := r.client.Watch(r.formatKey("slot"))
+	if err != nil {
+		return nil, err
+	}
+	return tx, tx.Unwatch().Err()
+}
+
+// Keyless commands go to a random node in cluster mode, run SCAN where pool keys live instead.
+func (r *RedisClient) scan(cursor int64, match string, count int64) (int64, []string, error) {
+	if r.node != nil {
+		return r.client.Scan(cursor, match, count).Result()
+	}
+	tx, err := r.multi()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Close()
+	return tx.Scan(cursor, match, count).Result()
+}
+
 // Always returns list of addresses. If Redis fails it will return empty list.
 func (r *RedisClient) GetBlacklist() ([]string, error) {
 	cmd := r.client.SMembers(r.formatKey("blacklist"))
@@ -109,7 +261,7 @@ func (r *RedisClient) GetBlacklist() ([]string, error) {
 	return cmd.Val(), nil
 }
 
-// Always returns list of IPs. If Redis fails it will return empty list.
+// Always returns list of IPs and CIDR ranges. If Redis fails it will return empty list.
 func (r *RedisClient) GetWhitelist() ([]string, error) {
 	cmd := r.client.SMembers(r.formatKey("whitelist"))
 	if cmd.Err() != nil {
@@ -118,13 +270,25 @@ func (r *RedisClient) GetWhitelist() ([]string, error) {
 	return cmd.Val(), nil
 }
 
+// Always returns list of IPs and CIDR ranges. If Redis fails it will return empty list.
+func (r *RedisClient) GetIPBlacklist() ([]string, error) {
+	cmd := r.client.SMembers(r.formatKey("ipblacklist"))
+	if cmd.Err() != nil {
+		return []string{}, cmd.Err()
+	}
+	return cmd.Val(), nil
+}
+
 func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	now := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		tx.HSet(r.formatKey("nodes"), join(id, "name"), id)
 		tx.HSet(r.formatKey("nodes"), join(id, "height"), strconv.FormatUint(height, 10))
 		tx.HSet(r.formatKey("nodes"), join(id, "difficulty"), diff.String())
@@ -159,14 +323,95 @@ func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 	return v, nil
 }
 
+// Lowest height kept in PoW backlog, exclusive
+func powBacklogMin(height uint64) string {
+	if height < 8 {
+		return "(0"
+	}
+	return fmt.Sprint("(", height-8)
+}
+
 func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error) {
 	// Sweep PoW backlog for previous blocks, we have 3 templates back in RAM
-	r.client.ZRemRangeByScore(r.formatKey("pow"), "-inf", fmt.Sprint("(", height-8))
+	r.client.ZRemRangeByScore(r.formatKey("pow"), "-inf", powBacklogMin(height))
+	val, err := r.client.ZAdd(r.formatKey("pow"), redis.Z{Score: float64(height), Member: strings.Join(params, ":")}).Result()
+	return val == 0, err
+}
+
+// Records PoW of a share which is going to be written later in a batch, returns true for duplicate.
+func (r *RedisClient) WritePoW(height uint64, params []string) (bool, error) {
 	val, err := r.client.ZAdd(r.formatKey("pow"), redis.Z{Score: float64(height), Member: strings.Join(params, ":")}).Result()
 	return val == 0, err
 }
 
-func (r *RedisClient) WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+// Stores hashrate reported by worker, it is ignored once expiration passes.
+func (r *RedisClient) WriteReportedHashrate(login, id string, hashrate int64, expiration time.Duration) error {
+	expiresAt := util.MakeTimestamp()/1000 + int64(expiration/time.Second)
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		tx.HSet(r.formatKey("reported", login), id, join(hashrate, expiresAt))
+		tx.Expire(r.formatKey("reported", login), expiration)
+		return nil
+	})
+	return err
+}
+
+// Writes accumulated shares at once, their PoW must be recorded with WritePoW already.
+func (r *RedisClient) WriteShares(shares []*Share, height uint64, window time.Duration) error {
+	if len(shares) == 0 {
+		return nil
+	}
+	rounds := make(map[string]int64)
+	expected := make(map[string]float64)
+	hashrates := make(map[string][]redis.Z)
+	lastShares := make(map[string]int64)
+	total := int64(0)
+	all := make([]redis.Z, 0, len(shares))
+	for _, v := range shares {
+		ts := v.Timestamp / 1000
+		rounds[v.Login] += v.Difficulty
+		if v.NetworkDifficulty > 0 {
+			expected[v.Login] += float64(v.Difficulty) / float64(v.NetworkDifficulty)
+		}
+		total += v.Difficulty
+		all = append(all, redis.Z{Score: float64(ts), Member: join(v.Difficulty, v.Login, v.Id, v.Timestamp)})
+		hashrates[v.Login] = append(hashrates[v.Login], redis.Z{Score: float64(ts), Member: join(v.Difficulty, v.Id, v.Timestamp)})
+		if ts > lastShares[v.Login] {
+			lastShares[v.Login] = ts
+		}
+	}
+
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		// Sweep PoW backlog for previous blocks, we have 3 templates back in RAM
+		tx.ZRemRangeByScore(r.formatKey("pow"), "-inf", powBacklogMin(height))
+		tx.ZAdd(r.formatKey("hashrate"), all...)
+		for login, diff := range rounds {
+			tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
+			tx.ZAdd(r.formatKey("hashrate", login), hashrates[login]...)
+			tx.Expire(r.formatKey("hashrate", login), window) // Will delete hashrates for miners that gone
+			tx.HSet(r.formatKey("miners", login), "lastShare", strconv.FormatInt(lastShares[login], 10))
+		}
+		for login, n := range expected {
+			tx.ZIncrBy(r.formatKey("expected"), n, login)
+		}
+		tx.HIncrBy(r.formatKey("stats"), "roundShares", total)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) WriteShare(login, id string, params []string, diff, netDiff int64, height uint64, window time.Duration) (bool, error) {
 	exist, err := r.checkPoWExist(height, params)
 	if err != nil {
 		return false, err
@@ -175,14 +420,17 @@ func (r *RedisClient) WriteShare(login, id string, params []string, diff int64,
 	if exist {
 		return true, nil
 	}
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return false, err
+	}
 	defer tx.Close()
 
 	ms := util.MakeTimestamp()
 	ts := ms / 1000
 
 	_, err = tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, window)
+		r.writeShare(tx, ms, ts, login, id, diff, netDiff, window)
 		tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
 		return nil
 	})
@@ -198,26 +446,36 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundD
 	if exist {
 		return true, nil
 	}
-	tx := r.client.Multi()
+	return false, r.WriteCheckedBlock(login, id, params, diff, roundDiff, height, window)
+}
+
+// Writes block solution whose PoW was already recorded by WritePoW and closes the round.
+func (r *RedisClient) WriteCheckedBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration) error {
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	ms := util.MakeTimestamp()
 	ts := ms / 1000
 
 	cmds, err := tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, window)
+		r.writeShare(tx, ms, ts, login, id, diff, roundDiff, window)
 		tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
 		tx.HDel(r.formatKey("stats"), "roundShares")
 		tx.ZIncrBy(r.formatKey("finders"), 1, login)
+		// Counted along with expected blocks, so both start at the same time
+		tx.ZIncrBy(r.formatKey("found"), 1, login)
 		tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
 		tx.Rename(r.formatKey("shares", "roundCurrent"), r.formatRound(int64(height), params[0]))
 		tx.HGetAllMap(r.formatRound(int64(height), params[0]))
 		return nil
 	})
 	if err != nil {
-		return false, err
+		return err
 	} else {
-		sharesMap, _ := cmds[10].(*redis.StringStringMapCmd).Result()
+		sharesMap, _ := cmds[len(cmds)-1].(*redis.StringStringMapCmd).Result()
 		totalShares := int64(0)
 		for _, v := range sharesMap {
 			n, _ := strconv.ParseInt(v, 10, 64)
@@ -226,12 +484,39 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundD
 		hashHex := strings.Join(params, ":")
 		s := join(hashHex, ts, roundDiff, totalShares)
 		cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
-		return false, cmd.Err()
+		return cmd.Err()
 	}
 }
 
-func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration) {
+// Keeps valid block solution that no upstream has accepted, so operators can investigate it.
+func (r *RedisClient) WriteFailedBlock(login, id string, params []string, roundDiff int64, height uint64) error {
+	ts := util.MakeTimestamp() / 1000
+	s := join(strings.Join(params, ":"), ts, roundDiff, login, id)
+	return r.client.ZAdd(r.formatKey("blocks", "failed"), redis.Z{Score: float64(height), Member: s}).Err()
+}
+
+// Remembers upstream which accepted block solution first, entries are kept for about a week of blocks.
+func (r *RedisClient) WriteBlockAcceptor(height uint64, nonce, upstream string) error {
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		tx.ZAdd(r.formatKey("blocks", "acceptors"), redis.Z{Score: float64(height), Member: join(nonce, upstream)})
+		tx.ZRemRangeByScore(r.formatKey("blocks", "acceptors"), "-inf", fmt.Sprint("(", int64(height)-40000))
+		return nil
+	})
+	return err
+}
+
+// Credits login with its share of expected block unless network difficulty is unknown.
+func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff, netDiff int64, expire time.Duration) {
 	tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
+	if netDiff > 0 {
+		tx.ZIncrBy(r.formatKey("expected"), float64(diff)/float64(netDiff), login)
+	}
 	tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
 	tx.ZAdd(r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
 	tx.Expire(r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
@@ -318,7 +603,7 @@ func (r *RedisClient) GetPayees() ([]string, error) {
 	for {
 		var keys []string
 		var err error
-		c, keys, err = r.client.Scan(c, r.formatKey("miners", "*"), 100).Result()
+		c, keys, err = r.scan(c, r.formatKey("miners", "*"), 100)
 		if err != nil {
 			return nil, err
 		}
@@ -412,12 +697,15 @@ func (r *RedisClient) GetPendingExchangePayments() []*PendingPayment {
 
 // Deduct miner's balance for payment
 func (r *RedisClient) UpdateBalance(login string, amount int64) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
 		tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
 		tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
@@ -429,10 +717,13 @@ func (r *RedisClient) UpdateBalance(login string, amount int64) error {
 }
 
 func (r *RedisClient) RollbackBalance(login string, amount int64) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
 		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
 		tx.HIncrBy(r.formatKey("finances"), "balance", amount)
@@ -444,12 +735,15 @@ func (r *RedisClient) RollbackBalance(login string, amount int64) error {
 }
 
 func (r *RedisClient) UpdateBalanceWithTx(login string, amount int64, txhash string) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
 		tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
 		tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
@@ -461,10 +755,13 @@ func (r *RedisClient) UpdateBalanceWithTx(login string, amount int64, txhash str
 }
 
 func (r *RedisClient) RollbackExchangeBalance(login string, amount int64, txhash string) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
 		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
 		tx.HIncrBy(r.formatKey("finances"), "balance", amount)
@@ -476,12 +773,15 @@ func (r *RedisClient) RollbackExchangeBalance(login string, amount int64, txhash
 }
 
 func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
 		tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
 		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
@@ -496,12 +796,15 @@ func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
 }
 
 func (r *RedisClient) WriteExchangePayment(login, txHash string, amount int64) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
 		tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
 		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
@@ -515,10 +818,13 @@ func (r *RedisClient) WriteExchangePayment(login, txHash string, amount int64) e
 }
 
 func (r *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		r.writeImmatureBlock(tx, block)
 		total := int64(0)
 		for login, amount := range roundRewards {
@@ -604,10 +910,13 @@ func (r *RedisClient) WriteOrphan(block *BlockData) error {
 }
 
 func (r *RedisClient) WritePendingOrphans(blocks []*BlockData) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		for _, block := range blocks {
 			r.writeImmatureBlock(tx, block)
 		}
@@ -638,7 +947,10 @@ func (r *RedisClient) IsMinerExists(login string) (bool, error) {
 func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error) {
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 
 	cmds, err := tx.Exec(func() error {
@@ -669,6 +981,143 @@ func (r *RedisClient) GetPayments(from, to string) []map[string]interface{} {
 	return convertPaymentsResults(pays)
 }
 
+type Payment struct {
+	Timestamp int64  `json:"timestamp"`
+	TxHash    string `json:"tx"`
+	Address   string `json:"address"`
+	Amount    int64  `json:"amount"`
+}
+
+// Returns matured blocks starting from given height, oldest first.
+func (r *RedisClient) GetMaturedBlocks(fromHeight int64) ([]*BlockData, error) {
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(fromHeight, 10), Max: "+inf"}
+	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("blocks", "matured"), option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertBlockResults(cmd), nil
+}
+
+func (r *RedisClient) GetBlockCredits(height int64, hash string) (map[string]int64, error) {
+	result := make(map[string]int64)
+	cmd := r.client.HGetAllMap(r.formatKey("credits", height, hash))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	for login, v := range cmd.Val() {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		result[login] = n
+	}
+	return result, nil
+}
+
+// Returns pool payments made since given unix timestamp, oldest first.
+func (r *RedisClient) GetPaymentsSince(ts int64) ([]*Payment, error) {
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(ts, 10), Max: "+inf"}
+	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("payments", "all"), option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertPayments(cmd), nil
+}
+
+// Returns current pool hashrate and hashrate of every active login.
+func (r *RedisClient) GetHashrateSnapshot(smallWindow time.Duration) (int64, map[string]int64, error) {
+	window := int64(smallWindow / time.Second)
+	now := util.MakeTimestamp() / 1000
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(now-window, 10), Max: "+inf"}
+	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("hashrate"), option)
+	if cmd.Err() != nil {
+		return 0, nil, cmd.Err()
+	}
+	totalHashrate, miners := convertMinersStats(window, cmd)
+	result := make(map[string]int64)
+	for login, miner := range miners {
+		result[login] = miner.HR
+	}
+	return totalHashrate, result, nil
+}
+
+// Returns the oldest matured blocks, leaving out keep most recent ones.
+func (r *RedisClient) GetOldestMaturedBlocks(keep int64) ([]*BlockData, error) {
+	cmd := r.client.ZRangeWithScores(r.formatKey("blocks", "matured"), 0, -(keep + 1))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertBlockResults(cmd), nil
+}
+
+// Drops given matured blocks with their credits, caller must make sure they are archived.
+func (r *RedisClient) TrimMaturedBlocks(blocks []*BlockData) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	// Credit log entries are "hash:timestamp:reward" scored by height
+	var logEntries []string
+	for _, block := range blocks {
+		height := strconv.FormatInt(block.Height, 10)
+		option := redis.ZRangeByScore{Min: height, Max: height}
+		entries, err := r.client.ZRangeByScoreWithScores(r.formatKey("credits", "all"), option).Result()
+		if err != nil {
+			return err
+		}
+		for _, v := range entries {
+			if member := v.Member.(string); strings.HasPrefix(member, block.Hash+":") {
+				logEntries = append(logEntries, member)
+			}
+		}
+	}
+
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		for _, block := range blocks {
+			tx.ZRem(r.formatKey("blocks", "matured"), block.immatureKey)
+			tx.Del(r.formatKey("credits", block.Height, block.Hash))
+		}
+		for _, v := range logEntries {
+			tx.ZRem(r.formatKey("credits", "all"), v)
+		}
+		return nil
+	})
+	return err
+}
+
+// Drops the oldest pool and per-account payment records up to maxTimestamp, leaving at least keep recent payments.
+func (r *RedisClient) TrimPayments(keep, maxTimestamp int64) (int64, error) {
+	cmd := r.client.ZRangeWithScores(r.formatKey("payments", "all"), 0, -(keep + 1))
+	if cmd.Err() != nil {
+		return 0, cmd.Err()
+	}
+	payments := convertPayments(cmd)
+	if len(payments) == 0 {
+		return 0, nil
+	}
+	tx, err := r.multi()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+
+	total := int64(0)
+	_, err = tx.Exec(func() error {
+		for _, v := range payments {
+			if v.Timestamp > maxTimestamp {
+				break
+			}
+			tx.ZRem(r.formatKey("payments", "all"), join(v.TxHash, v.Address, v.Amount))
+			tx.ZRem(r.formatKey("payments", v.Address), join(v.TxHash, v.Amount))
+			total++
+		}
+		return nil
+	})
+	return total, err
+}
+
 // Try to convert all numeric strings to int64
 func convertStringMap(m map[string]string) map[string]interface{} {
 	result := make(map[string]interface{})
@@ -698,7 +1147,7 @@ func (r *RedisClient) FlushStaleStats(window, largeWindow time.Duration) (int64,
 	for {
 		var keys []string
 		var err error
-		c, keys, err = r.client.Scan(c, r.formatKey("hashrate", "*"), 100).Result()
+		c, keys, err = r.scan(c, r.formatKey("hashrate", "*"), 100)
 		if err != nil {
 			return total, err
 		}
@@ -724,7 +1173,10 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 	window := int64(smallWindow / time.Second)
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 
 	now := util.MakeTimestamp() / 1000
@@ -741,6 +1193,8 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 		tx.ZCard(r.formatKey("blocks", "matured"))
 		tx.ZCard(r.formatKey("payments", "all"))
 		tx.ZRevRangeWithScores(r.formatKey("payments", "all"), 0, maxPayments-1)
+		tx.ZRevRangeWithScores(r.formatKey("blocks", "failed"), 0, maxBlocks-1)
+		tx.ZCard(r.formatKey("blocks", "failed"))
 		return nil
 	})
 
@@ -766,6 +1220,9 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 	stats["payments"] = payments
 	stats["paymentsTotal"] = cmds[9].(*redis.IntCmd).Val()
 
+	stats["failed"] = convertFailedBlockResults(cmds[11].(*redis.ZSliceCmd))
+	stats["failedTotal"] = cmds[12].(*redis.IntCmd).Val()
+
 	totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd))
 	stats["miners"] = miners
 	stats["minersTotal"] = len(miners)
@@ -778,7 +1235,10 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	largeWindow := int64(lWindow / time.Second)
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 
 	now := util.MakeTimestamp() / 1000
@@ -786,6 +1246,9 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	cmds, err := tx.Exec(func() error {
 		tx.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
 		tx.ZRangeWithScores(r.formatKey("hashrate", login), 0, -1)
+		tx.HGetAllMap(r.formatKey("reported", login))
+		tx.ZRemRangeByScore(r.formatKey("rejects", login), "-inf", fmt.Sprint("(", now-largeWindow))
+		tx.ZRangeWithScores(r.formatKey("rejects", login), 0, -1)
 		return nil
 	})
 
@@ -797,7 +1260,11 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	currentHashrate := int64(0)
 	online := int64(0)
 	offline := int64(0)
+	reportedHashrate := int64(0)
 	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd))
+	reported := convertReportedHashrates(now, cmds[2].(*redis.StringStringMapCmd))
+	addRejectedShares(workers, cmds[4].(*redis.ZSliceCmd))
+	shares := make(map[string]int64)
 
 	for id, worker := range workers {
 		timeOnline := now - worker.startedAt
@@ -824,6 +1291,17 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 			online++
 		}
 
+		if hr, ok := reported[id]; ok && hr > 0 {
+			worker.ReportedHR = hr
+			worker.Divergence = hashrateDivergence(hr, worker.TotalHR)
+			reportedHashrate += hr
+		}
+
+		shares[ShareStale] += worker.Stale
+		shares[ShareInvalid] += worker.Invalid
+		shares[ShareDuplicate] += worker.Duplicate
+		shares["valid"] += worker.Valid
+
 		currentHashrate += worker.HR
 		totalHashrate += worker.TotalHR
 		workers[id] = worker
@@ -834,13 +1312,21 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	stats["workersOffline"] = offline
 	stats["hashrate"] = totalHashrate
 	stats["currentHashrate"] = currentHashrate
+	stats["reportedHashrate"] = reportedHashrate
+	stats["shares"] = shares
+	if reportedHashrate > 0 {
+		stats["divergence"] = hashrateDivergence(reportedHashrate, totalHashrate)
+	}
 	return stats, nil
 }
 
 func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, error) {
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 
 	max := int64(windows[len(windows)-1])
@@ -911,6 +1397,25 @@ func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
 	return result
 }
 
+func convertFailedBlockResults(raw *redis.ZSliceCmd) []*FailedBlock {
+	var result []*FailedBlock
+	for _, v := range raw.Val() {
+		// "nonce:powHash:mixDigest:timestamp:diff:login:id"
+		block := FailedBlock{}
+		block.Height = int64(v.Score)
+		fields := strings.Split(v.Member.(string), ":")
+		block.Nonce = fields[0]
+		block.PowHash = fields[1]
+		block.MixDigest = fields[2]
+		block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
+		block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
+		block.Login = fields[5]
+		block.Worker = fields[6]
+		result = append(result, &block)
+	}
+	return result
+}
+
 func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
 	var result []*BlockData
 	for _, row := range rows {
@@ -952,6 +1457,7 @@ func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
 
 		// Add for large window
 		worker.TotalHR += share
+		worker.Valid++
 
 		// Add for small window if matches
 		if score >= now-window {
@@ -969,6 +1475,55 @@ func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
 	return workers
 }
 
+// Counts rejected shares of workers, worker which sent no valid shares is listed too.
+// Only valid shares keep worker online.
+func addRejectedShares(workers map[string]Worker, raw *redis.ZSliceCmd) {
+	for _, v := range raw.Val() {
+		// "kind:id:ns"
+		parts := strings.Split(v.Member.(string), ":")
+		if len(parts) != 3 {
+			continue
+		}
+		score := int64(v.Score)
+		worker := workers[parts[1]]
+		switch parts[0] {
+		case ShareStale:
+			worker.Stale++
+		case ShareInvalid:
+			worker.Invalid++
+		case ShareDuplicate:
+			worker.Duplicate++
+		}
+		if worker.startedAt > score || worker.startedAt == 0 {
+			worker.startedAt = score
+		}
+		workers[parts[1]] = worker
+	}
+}
+
+// Returns reported hashrate of workers which did not expire yet
+func convertReportedHashrates(now int64, raw *redis.StringStringMapCmd) map[string]int64 {
+	result := make(map[string]int64)
+	for id, v := range raw.Val() {
+		parts := strings.Split(v, ":")
+		if len(parts) != 2 {
+			continue
+		}
+		expiresAt, _ := strconv.ParseInt(parts[1], 10, 64)
+		if expiresAt < now {
+			continue
+		}
+		result[id], _ = strconv.ParseInt(parts[0], 10, 64)
+	}
+	return result
+}
+
+// Percent of reported hashrate missing from effective one, negative when effective is higher
+func hashrateDivergence(reported, effective int64) float64 {
+	d := float64(reported-effective) / float64(reported) * 100
+	return math.Floor(d*100+0.5) / 100
+}
+
 func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]Miner) {
 	now := util.MakeTimestamp() / 1000
 	miners := make(map[string]Miner)
@@ -1012,6 +1567,21 @@ func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]M
 	return totalHashrate, miners
 }
 
+// "txHash:address:amount" rows of the pool payments set
+func convertPayments(raw *redis.ZSliceCmd) []*Payment {
+	var result []*Payment
+	for _, v := range raw.Val() {
+		fields := strings.Split(v.Member.(string), ":")
+		if len(fields) < 3 {
+			continue
+		}
+		payment := Payment{Timestamp: int64(v.Score), TxHash: fields[0], Address: fields[1]}
+		payment.Amount, _ = strconv.ParseInt(fields[2], 10, 64)
+		result = append(result, &payment)
+	}
+	return result
+}
+
 func convertPaymentsResults(raw *redis.ZSliceCmd) []map[string]interface{} {
 	var result []map[string]interface{}
 	for _, v := range raw.Val() {
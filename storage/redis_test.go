@@ -1,12 +1,16 @@
 package storage
 
 import (
+	"math"
 	"os"
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
 	"gopkg.in/redis.v3"
+
+	"github.com/sero-cash/mine-pool/util"
 )
 
 var r *RedisClient
@@ -24,23 +28,23 @@ func TestMain(m *testing.M) {
 func TestWriteShareCheckExist(t *testing.T) {
 	reset()
 
-	exist, _ := r.WriteShare("x", "x", []string{"0x0", "0x0", "0x0"}, 10, 1008, 0)
+	exist, _ := r.WriteShare("x", "x", []string{"0x0", "0x0", "0x0"}, 10, 0, 1008, 0)
 	if exist {
 		t.Error("PoW must not exist")
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x1", "0x0"}, 10, 1008, 0)
+	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x1", "0x0"}, 10, 0, 1008, 0)
 	if exist {
 		t.Error("PoW must not exist")
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1010, 0)
+	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 0, 1010, 0)
 	if exist {
 		t.Error("PoW must not exist")
 	}
-	exist, _ = r.WriteShare("z", "x", []string{"0x0", "0x0", "0x1"}, 100, 1016, 0)
+	exist, _ = r.WriteShare("z", "x", []string{"0x0", "0x0", "0x1"}, 100, 0, 1016, 0)
 	if !exist {
 		t.Error("PoW must exist")
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1025, 0)
+	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 0, 1025, 0)
 	if exist {
 		t.Error("PoW must not exist")
 	}
@@ -321,9 +325,460 @@ func TestCollectLuckStats(t *testing.T) {
 	}
 }
 
+func TestTrimMaturedBlocks(t *testing.T) {
+	reset()
+
+	members := []redis.Z{
+		redis.Z{Score: 1, Member: "0:0:0x1:0xa:0:100:100:0"},
+		redis.Z{Score: 3, Member: "0:0:0x3:0xc:0:100:100:0"},
+		redis.Z{Score: 4, Member: "0:0:0x4:0xd:0:100:100:0"},
+	}
+	r.client.ZAdd(r.formatKey("blocks:matured"), members...)
+	r.client.HSet(r.formatKey("credits", int64(1), "0xa"), "x", "10")
+	r.client.HSet(r.formatKey("credits", int64(3), "0xc"), "x", "10")
+	r.client.ZAdd(r.formatKey("credits", "all"), redis.Z{Score: 1, Member: join("0xa", int64(1000), int64(10))})
+
+	blocks, _ := r.GetMaturedBlocks(3)
+	if len(blocks) != 2 || blocks[0].Height != 3 {
+		t.Error("Must return matured blocks from given height")
+	}
+	// Archive resumed from height 4, then block 2 matures late
+	archived, _ := r.GetMaturedBlocks(1)
+	r.client.ZAdd(r.formatKey("blocks:matured"), redis.Z{Score: 2, Member: "0:0:0x2:0xb:0:100:100:0"})
+	r.client.HSet(r.formatKey("credits", int64(2), "0xb"), "x", "10")
+	r.client.ZAdd(r.formatKey("credits", "all"), redis.Z{Score: 2, Member: join("0xb", int64(1000), int64(10))})
+
+	old, _ := r.GetOldestMaturedBlocks(1)
+	if len(old) != 3 || old[1].Height != 2 {
+		t.Fatalf("Must return all but kept blocks, got %v", len(old))
+	}
+	var trimmed []*BlockData
+	for _, block := range old {
+		for _, v := range archived {
+			if v.immatureKey == block.immatureKey {
+				trimmed = append(trimmed, block)
+			}
+		}
+	}
+	if err := r.TrimMaturedBlocks(trimmed); err != nil {
+		t.Fatalf("Failed to trim blocks: %v", err)
+	}
+	rest, _ := r.GetMaturedBlocks(0)
+	if len(rest) != 2 || rest[0].Height != 2 || rest[1].Height != 4 {
+		t.Errorf("Must keep late block and recent blocks, got %v", len(rest))
+	}
+	if exist, _ := r.client.Exists(r.formatKey("credits", int64(1), "0xa")).Result(); exist {
+		t.Error("Must remove credits of trimmed block")
+	}
+	if exist, _ := r.client.Exists(r.formatKey("credits", int64(2), "0xb")).Result(); !exist {
+		t.Error("Must not remove credits of late block which is not archived")
+	}
+	if entries := r.client.ZRangeWithScores(r.formatKey("credits", "all"), 0, -1).Val(); len(entries) != 1 || entries[0].Score != 2 {
+		t.Errorf("Must remove only credit log of trimmed blocks, got %v", entries)
+	}
+}
+
+func TestTrimPayments(t *testing.T) {
+	reset()
+
+	r.client.ZAdd(r.formatKey("payments:all"),
+		redis.Z{Score: 10, Member: join("0x1", "x", int64(100))},
+		redis.Z{Score: 20, Member: join("0x2", "y", int64(200))},
+		redis.Z{Score: 30, Member: join("0x3", "x", int64(300))},
+	)
+	r.client.ZAdd(r.formatKey("payments:x"),
+		redis.Z{Score: 10, Member: join("0x1", int64(100))},
+		redis.Z{Score: 30, Member: join("0x3", int64(300))},
+	)
+
+	payments, _ := r.GetPaymentsSince(20)
+	if len(payments) != 2 || payments[0].Address != "y" || payments[0].Amount != 200 {
+		t.Error("Must return payments since given timestamp")
+	}
+
+	n, _ := r.TrimPayments(1, 20)
+	if n != 2 {
+		t.Errorf("Must trim only archived payments, trimmed %v", n)
+	}
+	if r.client.ZCard(r.formatKey("payments:x")).Val() != 1 {
+		t.Error("Must trim account payments")
+	}
+	if r.client.ZCard(r.formatKey("payments:all")).Val() != 1 {
+		t.Error("Must keep recent payments")
+	}
+}
+
+func TestWriteSeriesSample(t *testing.T) {
+	reset()
+
+	cfg := &SeriesConfig{
+		ShortInterval: 10 * time.Minute, ShortRetention: 48 * time.Hour,
+		LongInterval: time.Hour, LongRetention: 720 * time.Hour,
+	}
+	bucket := SeriesBucket(cfg.LongInterval) + 1200
+	r.client.ZAdd(r.formatKey("hashrate"),
+		redis.Z{Score: float64(bucket - 600), Member: join(int64(6000), "x", "a", int64(1))},
+		redis.Z{Score: float64(bucket - 1), Member: join(int64(6000), "x", "b", int64(2))},
+		redis.Z{Score: float64(bucket), Member: join(int64(6000), "x", "b", int64(3))},
+	)
+	r.WriteRejectedShare("x", "a", ShareStale, time.Hour)
+	r.WriteRejectedShare("y", "a", ShareInvalid, time.Hour)
+	r.WriteRejectedShare("y", "a", ShareDuplicate, time.Hour)
+
+	ok, err := r.WriteSeriesSample(bucket, cfg)
+	if !ok || err != nil {
+		t.Fatalf("Must write sample: %v", err)
+	}
+	if ok, _ = r.WriteSeriesSample(bucket, cfg); ok {
+		t.Error("Must sample bucket only once")
+	}
+
+	pool, _ := r.GetSeries(SeriesShort, 0)
+	if len(pool) != 1 || pool[0].Hashrate != 20 || pool[0].Valid != 2 || pool[0].Stale != 1 || pool[0].Invalid != 1 {
+		t.Errorf("Invalid pool sample: %+v", pool)
+	}
+	worker, _ := r.GetSeries(SeriesShort, 0, "x", "b")
+	if len(worker) != 1 || worker[0].Hashrate != 10 || worker[0].Stale != 0 {
+		t.Errorf("Invalid worker sample: %+v", worker)
+	}
+	miner, _ := r.GetSeries(SeriesLong, 0, "x")
+	if len(miner) != 1 || miner[0].Hashrate != 3 || miner[0].Timestamp != bucket-1200 {
+		t.Errorf("Invalid long miner sample: %+v", miner)
+	}
+	if n := r.client.HLen(r.formatKey("sharecounts")).Val(); n != 0 {
+		t.Error("Must reset rejected share counters")
+	}
+
+	// No rejected shares since previous sample
+	ok, err = r.WriteSeriesSample(bucket+600, cfg)
+	if !ok || err != nil {
+		t.Fatalf("Must write sample without rejected shares: %v", err)
+	}
+	pool, _ = r.GetSeries(SeriesShort, 0)
+	if len(pool) != 2 || pool[1].Stale != 0 || pool[1].Invalid != 0 {
+		t.Errorf("Invalid pool sample without rejected shares: %+v", pool)
+	}
+}
+
 func reset() {
 	keys := r.client.Keys(r.prefix + ":*").Val()
 	for _, k := range keys {
 		r.client.Del(k)
 	}
 }
+
+func TestMigrate(t *testing.T) {
+	reset()
+
+	_, fresh, _ := r.GetSchemaVersion()
+	if !fresh {
+		t.Error("Empty database must be fresh")
+	}
+	if err := r.CheckSchema(); err != nil {
+		t.Errorf("Fresh database must pass schema check: %v", err)
+	}
+	version, _, _ := r.GetSchemaVersion()
+	if version != SchemaVersion {
+		t.Errorf("Fresh database must be stamped with %v, got %v", SchemaVersion, version)
+	}
+
+	reset()
+	r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: 10, Member: "0x1:0x2:0x3:1000:100:200"})
+	r.client.ZAdd(r.formatKey("blocks", "matured"), redis.Z{Score: 5, Member: "0:0:0x1:0x2:1000:100:200:5000"})
+	r.client.ZAdd(r.formatKey("blocks", "failed"), redis.Z{Score: 11, Member: "0x1:0x2:0x3:1000:100:login:worker"})
+
+	if err := r.Migrate(true); err != nil {
+		t.Errorf("Dry run failed: %v", err)
+	}
+	version, fresh, _ = r.GetSchemaVersion()
+	if version != 0 || fresh {
+		t.Errorf("Dry run must not change version, got %v", version)
+	}
+
+	if err := r.Migrate(false); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+	if err := r.CheckSchema(); err != nil {
+		t.Errorf("Migrated data must pass schema check: %v", err)
+	}
+
+	// Unversioned data is migrated on startup
+	reset()
+	r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: 10, Member: "0x1:0x2:0x3:1000:100:200"})
+	if err := r.CheckSchema(); err != nil {
+		t.Errorf("Unversioned data must be migrated by schema check: %v", err)
+	}
+	version, _, _ = r.GetSchemaVersion()
+	if version != SchemaVersion {
+		t.Errorf("Schema check must stamp migrated data with %v, got %v", SchemaVersion, version)
+	}
+
+	reset()
+	r.client.ZAdd(r.formatKey("blocks", "immature"), redis.Z{Score: 5, Member: "0:0:0x1:0x2:1000"})
+	if err := r.Migrate(false); err == nil {
+		t.Error("Malformed block record must fail migration")
+	}
+	if err := r.CheckSchema(); err == nil {
+		t.Error("Malformed block record must fail schema check")
+	}
+	version, _, _ = r.GetSchemaVersion()
+	if version != 0 {
+		t.Errorf("Failed migration must not change version, got %v", version)
+	}
+
+	reset()
+	r.client.ZAdd(r.formatKey("blocks", "failed"), redis.Z{Score: 11, Member: "0x1:0x2:0x3:1000:100"})
+	if err := r.Migrate(false); err == nil {
+		t.Error("Malformed failed block record must fail migration")
+	}
+
+	reset()
+	r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: 10, Member: "0x1:0x2:0x3:1000:100:200"})
+	r.client.Set(r.formatKey("schema", "lock"), "1", 0)
+	if err := r.Migrate(false); err != ErrMigrationInProgress {
+		t.Errorf("Locked migration must report it is in progress, got %v", err)
+	}
+	r.client.Del(r.formatKey("schema", "lock"))
+}
+
+func TestWriteShares(t *testing.T) {
+	reset()
+
+	exist, _ := r.WritePoW(1000, []string{"0x0", "0x0", "0x0"})
+	if exist {
+		t.Error("PoW must not exist")
+	}
+	exist, _ = r.WritePoW(1000, []string{"0x0", "0x0", "0x0"})
+	if !exist {
+		t.Error("PoW must exist")
+	}
+
+	shares := []*Share{
+		&Share{Login: "x", Id: "a", Difficulty: 10, Timestamp: 1000000},
+		&Share{Login: "x", Id: "b", Difficulty: 20, Timestamp: 1001000},
+		&Share{Login: "y", Id: "a", Difficulty: 30, Timestamp: 1002000},
+	}
+	err := r.WriteShares(shares, 1000, time.Hour)
+	if err != nil {
+		t.Errorf("Failed to write shares: %v", err)
+	}
+
+	round := r.client.HGetAllMap(r.formatKey("shares", "roundCurrent")).Val()
+	if round["x"] != "30" || round["y"] != "30" {
+		t.Errorf("Invalid round shares: %v", round)
+	}
+	roundShares := r.client.HGet(r.formatKey("stats"), "roundShares").Val()
+	if roundShares != "60" {
+		t.Errorf("Invalid total round shares: %v", roundShares)
+	}
+	if n := r.client.ZCard(r.formatKey("hashrate")).Val(); n != 3 {
+		t.Errorf("Must write every share to pool hashrate, got %v", n)
+	}
+	if n := r.client.ZCard(r.formatKey("hashrate", "x")).Val(); n != 2 {
+		t.Errorf("Must write every share to miner hashrate, got %v", n)
+	}
+	lastShare := r.client.HGet(r.formatKey("miners", "x"), "lastShare").Val()
+	if lastShare != "1001" {
+		t.Errorf("Invalid last share timestamp: %v", lastShare)
+	}
+}
+
+func TestWriteFailedBlock(t *testing.T) {
+	reset()
+
+	err := r.WriteFailedBlock("x", "rig", []string{"0x1", "0x2", "0x3"}, 5000, 100)
+	if err != nil {
+		t.Errorf("Failed to write failed block: %v", err)
+	}
+	stats, err := r.CollectStats(time.Minute, 10, 10)
+	if err != nil {
+		t.Errorf("Failed to collect stats: %v", err)
+	}
+	if stats["failedTotal"].(int64) != 1 {
+		t.Errorf("Invalid number of failed blocks: %v", stats["failedTotal"])
+	}
+	failed := stats["failed"].([]*FailedBlock)
+	if failed[0].Height != 100 || failed[0].Login != "x" || failed[0].Worker != "rig" || failed[0].MixDigest != "0x3" || failed[0].Difficulty != 5000 {
+		t.Errorf("Invalid failed block: %v", failed[0])
+	}
+}
+
+func TestCollectWorkersReportedHashrate(t *testing.T) {
+	reset()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	shares := []*Share{
+		&Share{Login: "x", Id: "a", Difficulty: 60000, Timestamp: now},
+		&Share{Login: "x", Id: "b", Difficulty: 60000, Timestamp: now},
+	}
+	if err := r.WriteShares(shares, 1000, time.Hour); err != nil {
+		t.Errorf("Failed to write shares: %v", err)
+	}
+	r.WriteReportedHashrate("x", "a", 200, time.Hour)
+	r.client.HSet(r.formatKey("reported", "x"), "b", join(int64(400), now/1000-1))
+
+	stats, err := r.CollectWorkersStats(time.Hour, time.Hour, "x")
+	if err != nil {
+		t.Errorf("Failed to collect workers stats: %v", err)
+	}
+	workers := stats["workers"].(map[string]Worker)
+	if workers["a"].ReportedHR != 200 || workers["a"].Divergence != 50 {
+		t.Errorf("Invalid reported hashrate of worker: %v", workers["a"])
+	}
+	if workers["b"].ReportedHR != 0 {
+		t.Errorf("Expired reported hashrate must be ignored: %v", workers["b"])
+	}
+	if stats["reportedHashrate"].(int64) != 200 {
+		t.Errorf("Invalid total reported hashrate: %v", stats["reportedHashrate"])
+	}
+}
+
+func TestCollectWorkersRejectedShares(t *testing.T) {
+	reset()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	shares := []*Share{
+		&Share{Login: "x", Id: "a", Difficulty: 10, Timestamp: now},
+		&Share{Login: "x", Id: "a", Difficulty: 10, Timestamp: now + 1},
+	}
+	if err := r.WriteShares(shares, 1000, time.Hour); err != nil {
+		t.Errorf("Failed to write shares: %v", err)
+	}
+	r.WriteRejectedShare("x", "a", ShareStale, time.Hour)
+	r.WriteRejectedShare("x", "a", ShareStale, time.Hour)
+	r.WriteRejectedShare("x", "a", ShareDuplicate, time.Hour)
+	r.WriteRejectedShare("x", "b", ShareInvalid, time.Hour)
+
+	stats, err := r.CollectWorkersStats(time.Hour, time.Hour, "x")
+	if err != nil {
+		t.Errorf("Failed to collect workers stats: %v", err)
+	}
+	workers := stats["workers"].(map[string]Worker)
+	a := workers["a"]
+	if a.Valid != 2 || a.Stale != 2 || a.Duplicate != 1 || a.Invalid != 0 {
+		t.Errorf("Invalid share counts of worker: %+v", a)
+	}
+	if b, ok := workers["b"]; !ok || b.Invalid != 1 || b.Valid != 0 {
+		t.Errorf("Worker with rejected shares only must be listed: %+v", b)
+	}
+	if a.Offline || !workers["b"].Offline {
+		t.Errorf("Only worker with valid shares must be online: %+v %+v", a, workers["b"])
+	}
+	total := stats["shares"].(map[string]int64)
+	if total["valid"] != 2 || total[ShareStale] != 2 || total[ShareInvalid] != 1 || total[ShareDuplicate] != 1 {
+		t.Errorf("Invalid total share counts: %v", total)
+	}
+}
+
+func TestWriteBan(t *testing.T) {
+	reset()
+
+	received := make(chan *Ban, 1)
+	quit := make(chan struct{})
+	stopped := make(chan error, 1)
+	go func() { stopped <- r.SubscribeBans(func(ban *Ban) { received <- ban }, quit) }()
+	time.Sleep(100 * time.Millisecond)
+
+	now := util.MakeTimestamp()
+	r.WriteBan(&Ban{IP: "10.0.0.1", Reason: "malformed", BannedAt: now, ExpiresAt: now + 60000})
+	r.WriteBan(&Ban{IP: "10.0.0.2", Reason: "malformed", BannedAt: now - 120000, ExpiresAt: now - 60000})
+
+	select {
+	case ban := <-received:
+		if ban.IP != "10.0.0.1" || ban.Reason != "malformed" {
+			t.Errorf("Unexpected announced ban %+v", ban)
+		}
+	case <-time.After(time.Second):
+		t.Error("Ban must be announced")
+	}
+
+	bans, err := r.GetBans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans[0].IP != "10.0.0.1" || bans[0].ExpiresAt != now+60000 {
+		t.Errorf("Expected only ban in effect, got %+v", bans)
+	}
+	if r.client.HLen(r.formatKey("bans")).Val() != 1 {
+		t.Error("Expired ban must be removed")
+	}
+
+	close(quit)
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Stopped subscription must not fail: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Subscription must stop on quit")
+	}
+}
+
+func TestBlockExpectations(t *testing.T) {
+	reset()
+
+	// Blocks found before expectations were tracked must not offset them
+	r.client.ZAdd(r.formatKey("finders"), redis.Z{Score: 5, Member: "x"})
+
+	r.WriteShare("x", "a", []string{"0x0", "0x0", "0x0"}, 300, 1000, 1000, time.Hour)
+	r.WriteShare("y", "a", []string{"0x0", "0x0", "0x1"}, 100, 1000, 1000, time.Hour)
+	r.WriteBlock("y", "a", []string{"0x0", "0x0", "0x2"}, 100, 1000, 1000, time.Hour)
+
+	r.WritePoW(1001, []string{"0x0", "0x0", "0x3"})
+	r.WriteShares([]*Share{
+		&Share{Login: "x", Id: "a", Difficulty: 500, NetworkDifficulty: 1000, Timestamp: 1000000},
+		// Unknown network difficulty is not credited
+		&Share{Login: "x", Id: "a", Difficulty: 500, Timestamp: 1001000},
+	}, 1001, time.Hour)
+	r.WriteBlock("x", "a", []string{"0x0", "0x0", "0x4"}, 500, 1000, 1001, time.Hour)
+
+	expectations, err := r.GetBlockExpectations(0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expectations) != 1 {
+		t.Fatalf("Expected only login above minimum, got %v", len(expectations))
+	}
+	if e := expectations[0]; e.Login != "x" || math.Abs(e.Expected-1.3) > 1e-9 || e.Found != 1 {
+		t.Errorf("Invalid block expectation %+v", e)
+	}
+
+	held, _ := r.HoldPayouts("x", "withholding")
+	if !held {
+		t.Error("Login must be held")
+	}
+	if held, _ := r.IsPayoutHeld("x"); !held {
+		t.Error("Payouts must be held")
+	}
+	if existed, err := r.ReleasePayouts("x"); !existed || err != nil {
+		t.Errorf("Held login must be released: %v", err)
+	}
+	if held, _ := r.HoldPayouts("x", "withholding"); held {
+		t.Error("Released login must not be held again")
+	}
+	if held, _ := r.IsPayoutHeld("x"); held {
+		t.Error("Released payouts must not be held")
+	}
+	if held, _ := r.IsPayoutHeld("y"); held {
+		t.Error("Payouts of y must not be held")
+	}
+	if existed, _ := r.ReleasePayouts("y"); existed {
+		t.Error("Login without hold must be reported")
+	}
+	if held, _ := r.HoldPayouts("y", "withholding"); held {
+		t.Error("Login released in advance must not be held")
+	}
+}
+
+func TestWriteSharesLowHeight(t *testing.T) {
+	reset()
+
+	r.WritePoW(5, []string{"0x0", "0x0", "0x0"})
+	err := r.WriteShares([]*Share{&Share{Login: "x", Id: "a", Difficulty: 10, Timestamp: 1000000}}, 5, time.Hour)
+	if err != nil {
+		t.Errorf("Failed to write shares: %v", err)
+	}
+	if n := r.client.ZCard(r.formatKey("pow")).Val(); n != 1 {
+		t.Errorf("PoW backlog must be kept at low height, got %v entries", n)
+	}
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// Version of record formats written by this build
+const SchemaVersion = 1
+
+type Migration struct {
+	Version     int
+	Description string
+	// Upgrades data from the previous version in place, must not write anything on dry run.
+	// Returns number of records that were (or would be) upgraded or stamped.
+	Up func(r *RedisClient, dryRun bool) (int64, error)
+}
+
+// Ordered list of forward migrations, Version of each entry is the schema version it produces.
+// Never edit an entry that may already be deployed, append a new one and bump SchemaVersion instead.
+var migrations = []Migration{
+	{1, "Stamp block records written before schema versioning", stampBlockRecords},
+}
+
+var ErrMigrationInProgress = errors.New("Another migration is in progress")
+
+// Pause between checks while other instance holds migration lock
+const migrationPollInterval = 5 * time.Second
+
+// Returns stored schema version. Unversioned database holding pool data is reported as version 0,
+// fresh is set when there is no data at all.
+func (r *RedisClient) GetSchemaVersion() (version int, fresh bool, err error) {
+	v, err := r.client.Get(r.formatKey("schema", "version")).Result()
+	if err == nil {
+		version, err = strconv.Atoi(v)
+		return version, false, err
+	}
+	if err != redis.Nil {
+		return 0, false, err
+	}
+	var c int64
+	for {
+		var keys []string
+		c, keys, err = r.scan(c, r.formatKey("*"), 100)
+		if err != nil || len(keys) > 0 {
+			return 0, false, err
+		}
+		if c == 0 {
+			return 0, true, nil
+		}
+	}
+}
+
+// Must be called on startup before any module writes data.
+// Stamps fresh database with current version, applies pending migrations to older data
+// and refuses to run against data of newer version.
+func (r *RedisClient) CheckSchema() error {
+	version, fresh, err := r.GetSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if fresh {
+		return r.client.SetNX(r.formatKey("schema", "version"), strconv.Itoa(SchemaVersion), 0).Err()
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("Storage schema version %v is newer than %v supported by this build", version, SchemaVersion)
+	}
+	if version == SchemaVersion {
+		return nil
+	}
+	log.Printf("Storage schema version %v is behind %v, applying migrations", version, SchemaVersion)
+	for {
+		err = r.Migrate(false)
+		if err != ErrMigrationInProgress {
+			return err
+		}
+		// Instances started together wait for the one holding the lock
+		log.Printf("Waiting for storage migration by another instance")
+		time.Sleep(migrationPollInterval)
+	}
+}
+
+// Applies all pending migrations one by one, storing new version after each of them.
+// On dry run every pending migration only reports what it would change.
+func (r *RedisClient) Migrate(dryRun bool) error {
+	version, fresh, err := r.GetSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if fresh {
+		log.Printf("Database is empty, nothing to migrate")
+		if dryRun {
+			return nil
+		}
+		return r.client.Set(r.formatKey("schema", "version"), strconv.Itoa(SchemaVersion), 0).Err()
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("Storage schema version %v is newer than %v supported by this build", version, SchemaVersion)
+	}
+	if version == SchemaVersion {
+		log.Printf("Storage schema is up to date at version %v", version)
+		return nil
+	}
+
+	ok, err := r.client.SetNX(r.formatKey("schema", "lock"), "1", time.Hour).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrMigrationInProgress
+	}
+	defer r.client.Del(r.formatKey("schema", "lock"))
+
+	// Other instance may have finished migration before lock was taken
+	version, _, err = r.GetSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		start := time.Now()
+		n, err := m.Up(r, dryRun)
+		if err != nil {
+			return fmt.Errorf("Migration %v failed: %v", m.Version, err)
+		}
+		if dryRun {
+			log.Printf("Migration %v (%s) would process %v records", m.Version, m.Description, n)
+			continue
+		}
+		err = r.client.Set(r.formatKey("schema", "version"), strconv.Itoa(m.Version), 0).Err()
+		if err != nil {
+			return err
+		}
+		log.Printf("Applied migration %v (%s), %v records, elapsed time %v", m.Version, m.Description, n, time.Since(start))
+	}
+	return nil
+}
+
+// Rewrites members of sorted set keeping their scores, fn returns member unchanged if it needs no upgrade.
+func (r *RedisClient) rewriteZSet(key string, dryRun bool, fn func(member string) (string, error)) (int64, error) {
+	rows, err := r.client.ZRangeWithScores(key, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	changed := make(map[string]redis.Z)
+	for _, v := range rows {
+		member := v.Member.(string)
+		upgraded, err := fn(member)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %q: %v", key, member, err)
+		}
+		if upgraded != member {
+			changed[member] = redis.Z{Score: v.Score, Member: upgraded}
+		}
+	}
+	if dryRun || len(changed) == 0 {
+		return int64(len(changed)), nil
+	}
+
+	tx, err := r.multi()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		for member, z := range changed {
+			tx.ZRem(key, member)
+			tx.ZAdd(key, z)
+		}
+		return nil
+	})
+	return int64(len(changed)), err
+}
+
+// Block records are parsed by position, stamps version 1 on data having the expected layout
+// and refuses to stamp anything else. Returns number of stamped records.
+func stampBlockRecords(r *RedisClient, dryRun bool) (int64, error) {
+	layouts := map[string]int{
+		r.formatKey("blocks", "candidates"): 6,
+		r.formatKey("blocks", "immature"):   8,
+		r.formatKey("blocks", "matured"):    8,
+		r.formatKey("blocks", "failed"):     7,
+	}
+	var total int64
+	for key, fields := range layouts {
+		_, err := r.rewriteZSet(key, dryRun, func(member string) (string, error) {
+			if n := len(strings.Split(member, ":")); n != fields {
+				return member, fmt.Errorf("expected %v fields, got %v", fields, n)
+			}
+			total++
+			return member, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
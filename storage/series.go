@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/sero-cash/mine-pool/util"
+)
+
+const (
+	ShareStale     = "stale"
+	ShareInvalid   = "invalid"
+	ShareDuplicate = "duplicate"
+)
+
+// Downsampled series resolutions
+const (
+	SeriesShort = "short"
+	SeriesLong  = "long"
+)
+
+type SeriesPoint struct {
+	Timestamp int64 `json:"timestamp"`
+	Hashrate  int64 `json:"hashrate"`
+	Valid     int64 `json:"valid"`
+	Stale     int64 `json:"stale"`
+	Invalid   int64 `json:"invalid"`
+}
+
+func (p *SeriesPoint) add(x *SeriesPoint) {
+	p.Hashrate += x.Hashrate
+	p.Valid += x.Valid
+	p.Stale += x.Stale
+	p.Invalid += x.Invalid
+}
+
+func (p *SeriesPoint) key() string {
+	return join(p.Timestamp, p.Hashrate, p.Valid, p.Stale, p.Invalid)
+}
+
+type SeriesConfig struct {
+	ShortInterval  time.Duration
+	ShortRetention time.Duration
+	LongInterval   time.Duration
+	LongRetention  time.Duration
+}
+
+// Records rejected share of worker within window, kind is ShareStale, ShareInvalid or ShareDuplicate.
+// Stale and invalid shares are also counted for the next series sample.
+func (r *RedisClient) WriteRejectedShare(login, id, kind string, window time.Duration) error {
+	now := time.Now()
+	ts := now.Unix()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		if kind != ShareDuplicate {
+			tx.HIncrBy(r.formatKey("sharecounts"), join(login, id, kind), 1)
+		}
+		tx.ZAdd(r.formatKey("rejects", login), redis.Z{Score: float64(ts), Member: join(kind, id, now.UnixNano())})
+		tx.ZRemRangeByScore(r.formatKey("rejects", login), "-inf", "("+strconv.FormatInt(ts-int64(window/time.Second), 10))
+		tx.Expire(r.formatKey("rejects", login), window)
+		return nil
+	})
+	return err
+}
+
+// Samples hashrate and share counts of the short interval ending at bucket for the pool,
+// every login and every worker, and folds them into the long interval series.
+// Returns false if the bucket was already sampled by another instance.
+func (r *RedisClient) WriteSeriesSample(bucket int64, cfg *SeriesConfig) (bool, error) {
+	shortIntv := int64(cfg.ShortInterval / time.Second)
+	longIntv := int64(cfg.LongInterval / time.Second)
+
+	ok, err := r.client.SetNX(r.formatKey("series", "lock", bucket), "1", cfg.LongInterval).Result()
+	if err != nil || !ok {
+		return false, err
+	}
+
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(bucket-shortIntv, 10), Max: "(" + strconv.FormatInt(bucket, 10)}
+	shares := r.client.ZRangeByScoreWithScores(r.formatKey("hashrate"), option)
+	if shares.Err() != nil {
+		return false, shares.Err()
+	}
+	counts, err := r.popShareCounts(bucket)
+	if err != nil {
+		return false, err
+	}
+
+	// Scope key => sample: "pool", "miner:login", "worker:login:id"
+	samples := map[string]*SeriesPoint{"pool": &SeriesPoint{}}
+	sample := func(scope string) *SeriesPoint {
+		p, ok := samples[scope]
+		if !ok {
+			p = &SeriesPoint{}
+			samples[scope] = p
+		}
+		return p
+	}
+	for _, v := range shares.Val() {
+		// "diff:login:id:ms"
+		parts := strings.Split(v.Member.(string), ":")
+		diff, _ := strconv.ParseInt(parts[0], 10, 64)
+		x := &SeriesPoint{Hashrate: diff, Valid: 1}
+		samples["pool"].add(x)
+		sample(join("miner", parts[1])).add(x)
+		sample(join("worker", parts[1], parts[2])).add(x)
+	}
+	for field, v := range counts {
+		// "login:id:kind"
+		parts := strings.Split(field, ":")
+		n, _ := strconv.ParseInt(v, 10, 64)
+		x := &SeriesPoint{}
+		if parts[2] == ShareStale {
+			x.Stale = n
+		} else {
+			x.Invalid = n
+		}
+		samples["pool"].add(x)
+		sample(join("miner", parts[0])).add(x)
+		sample(join("worker", parts[0], parts[1])).add(x)
+	}
+
+	hour := bucket - shortIntv - (bucket-shortIntv)%longIntv
+	tx, err := r.multi()
+	if err != nil {
+		return true, err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		for scope, p := range samples {
+			p.Timestamp = bucket - shortIntv
+			p.Hashrate = p.Hashrate / shortIntv
+			key := r.formatKey("series", SeriesShort, scope)
+			tx.ZAdd(key, redis.Z{Score: float64(p.Timestamp), Member: p.key()})
+			tx.ZRemRangeByScore(key, "-inf", "("+strconv.FormatInt(bucket-int64(cfg.ShortRetention/time.Second), 10))
+			tx.Expire(key, cfg.ShortRetention)
+		}
+		return nil
+	})
+	if err != nil {
+		return true, err
+	}
+
+	// Recalculate long interval point from all short points inside it, missing points count as zero
+	scopes := make([]string, 0, len(samples))
+	for scope := range samples {
+		scopes = append(scopes, scope)
+	}
+	rtx, err := r.multi()
+	if err != nil {
+		return true, err
+	}
+	defer rtx.Close()
+
+	option = redis.ZRangeByScore{Min: strconv.FormatInt(hour, 10), Max: "(" + strconv.FormatInt(hour+longIntv, 10)}
+	cmds, err := rtx.Exec(func() error {
+		for _, scope := range scopes {
+			rtx.ZRangeByScoreWithScores(r.formatKey("series", SeriesShort, scope), option)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return true, err
+	}
+
+	ratio := longIntv / shortIntv
+	ltx, err := r.multi()
+	if err != nil {
+		return true, err
+	}
+	defer ltx.Close()
+
+	_, err = ltx.Exec(func() error {
+		for i, scope := range scopes {
+			p := &SeriesPoint{Timestamp: hour}
+			for _, x := range convertSeriesResults(cmds[i].(*redis.ZSliceCmd)) {
+				p.add(x)
+			}
+			p.Hashrate = p.Hashrate / ratio
+			key := r.formatKey("series", SeriesLong, scope)
+			ltx.ZRemRangeByScore(key, strconv.FormatInt(hour, 10), strconv.FormatInt(hour, 10))
+			ltx.ZAdd(key, redis.Z{Score: float64(hour), Member: p.key()})
+			ltx.ZRemRangeByScore(key, "-inf", "("+strconv.FormatInt(bucket-int64(cfg.LongRetention/time.Second), 10))
+			ltx.Expire(key, cfg.LongRetention)
+		}
+		return nil
+	})
+	return true, err
+}
+
+// Atomically takes rejected share counters accumulated since previous sample.
+// Counters only disappear by this rename, which runs under sampling lock.
+func (r *RedisClient) popShareCounts(bucket int64) (map[string]string, error) {
+	exists, err := r.client.Exists(r.formatKey("sharecounts")).Result()
+	if err != nil {
+		return nil, err
+	}
+	// Nothing was counted
+	if !exists {
+		return map[string]string{}, nil
+	}
+	key := r.formatKey("sharecounts", bucket)
+	err = r.client.Rename(r.formatKey("sharecounts"), key).Err()
+	if err != nil {
+		return nil, err
+	}
+	cmd := r.client.HGetAllMap(key)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	r.client.Del(key)
+	return cmd.Val(), nil
+}
+
+// Scope is "pool", login or login with worker id.
+func (r *RedisClient) GetSeries(resolution string, from int64, scope ...string) ([]*SeriesPoint, error) {
+	var key string
+	switch len(scope) {
+	case 0:
+		key = r.formatKey("series", resolution, "pool")
+	case 1:
+		key = r.formatKey("series", resolution, "miner", scope[0])
+	default:
+		key = r.formatKey("series", resolution, "worker", scope[0], scope[1])
+	}
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(from, 10), Max: "+inf"}
+	cmd := r.client.ZRangeByScoreWithScores(key, option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertSeriesResults(cmd), nil
+}
+
+func convertSeriesResults(raw *redis.ZSliceCmd) []*SeriesPoint {
+	var result []*SeriesPoint
+	for _, v := range raw.Val() {
+		// "timestamp:hashrate:valid:stale:invalid"
+		fields := strings.Split(v.Member.(string), ":")
+		p := SeriesPoint{Timestamp: int64(v.Score)}
+		p.Hashrate, _ = strconv.ParseInt(fields[1], 10, 64)
+		p.Valid, _ = strconv.ParseInt(fields[2], 10, 64)
+		p.Stale, _ = strconv.ParseInt(fields[3], 10, 64)
+		p.Invalid, _ = strconv.ParseInt(fields[4], 10, 64)
+		result = append(result, &p)
+	}
+	return result
+}
+
+// End of the last completed interval at this moment.
+func SeriesBucket(interval time.Duration) int64 {
+	now := util.MakeTimestamp() / 1000
+	intv := int64(interval / time.Second)
+	return now - now%intv
+}
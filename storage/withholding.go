@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"strconv"
+
+	"gopkg.in/redis.v3"
+)
+
+// Value of payout hold cleared by operator, such login is not held again
+const PayoutReleased = "released"
+
+// Blocks found by login against blocks its shares should have found
+type BlockExpectation struct {
+	Login    string  `json:"login"`
+	Expected float64 `json:"expected"`
+	Found    int64   `json:"found"`
+}
+
+// Returns logins expected to find at least minExpected blocks. Expected blocks are credited
+// by share writes and found blocks by block writes, so both count from the same deploy.
+func (r *RedisClient) GetBlockExpectations(minExpected float64) ([]*BlockExpectation, error) {
+	option := redis.ZRangeByScore{Min: strconv.FormatFloat(minExpected, 'f', -1, 64), Max: "+inf"}
+	expected, err := r.client.ZRangeByScoreWithScores(r.formatKey("expected"), option).Result()
+	if err != nil {
+		return nil, err
+	}
+	finders, err := r.client.ZRangeWithScores(r.formatKey("found"), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]int64, len(finders))
+	for _, v := range finders {
+		found[v.Member.(string)] = int64(v.Score)
+	}
+	result := make([]*BlockExpectation, 0, len(expected))
+	for _, v := range expected {
+		login := v.Member.(string)
+		result = append(result, &BlockExpectation{Login: login, Expected: v.Score, Found: found[login]})
+	}
+	return result, nil
+}
+
+// Holds payouts of login, returns false if login already has hold entry, including released one.
+func (r *RedisClient) HoldPayouts(login, reason string) (bool, error) {
+	tx, err := r.multi()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		tx.HSetNX(r.formatKey("payouts", "holds"), login, reason)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return cmds[0].(*redis.BoolCmd).Val(), nil
+}
+
+// Releases payouts of login, released login is not held automatically again.
+// Returns false if login had no hold.
+func (r *RedisClient) ReleasePayouts(login string) (bool, error) {
+	tx, err := r.multi()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		tx.HExists(r.formatKey("payouts", "holds"), login)
+		tx.HSet(r.formatKey("payouts", "holds"), login, PayoutReleased)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return cmds[0].(*redis.BoolCmd).Val(), nil
+}
+
+func (r *RedisClient) IsPayoutHeld(login string) (bool, error) {
+	cmd := r.client.HGet(r.formatKey("payouts", "holds"), login)
+	if cmd.Err() == redis.Nil {
+		return false, nil
+	} else if cmd.Err() != nil {
+		return false, cmd.Err()
+	}
+	return cmd.Val() != PayoutReleased, nil
+}
+
+// Returns hold reasons by login, released holds are included.
+func (r *RedisClient) GetPayoutHolds() (map[string]string, error) {
+	return r.client.HGetAllMap(r.formatKey("payouts", "holds")).Result()
+}
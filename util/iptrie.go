@@ -0,0 +1,133 @@
+package util
+
+import (
+	"net"
+	"strings"
+)
+
+// Set of IP ranges, lookup walks at most one node per address bit.
+// IPv4 ranges are kept as IPv4-mapped IPv6, so both families share one tree.
+type IPTrie struct {
+	root ipTrieNode
+	size int
+}
+
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	// Range ending at this node is in the set
+	terminal bool
+}
+
+func NewIPTrie() *IPTrie {
+	return &IPTrie{}
+}
+
+// Parses CIDR range or bare address, which stands for a single host.
+func ParseIPNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// Returns /24 network of IPv4 or /64 network of IPv6 address, empty string if address is invalid.
+func Subnet(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	if v4 := addr.To4(); v4 != nil {
+		mask := net.CIDRMask(24, 32)
+		return (&net.IPNet{IP: v4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(64, 128)
+	return (&net.IPNet{IP: addr.Mask(mask), Mask: mask}).String()
+}
+
+// Address bits and prefix length in 128-bit space
+func trieKey(n *net.IPNet) (net.IP, int) {
+	ones, bits := n.Mask.Size()
+	if bits == 32 {
+		ones += 96
+	}
+	return n.IP.To16(), ones
+}
+
+func bitAt(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// Adds range given as CIDR or bare address.
+func (t *IPTrie) Insert(cidr string) error {
+	n, err := ParseIPNet(cidr)
+	if err != nil {
+		return err
+	}
+	ip, ones := trieKey(n)
+	node := &t.root
+	for i := 0; i < ones; i++ {
+		b := bitAt(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = &ipTrieNode{}
+		}
+		node = node.children[b]
+	}
+	if !node.terminal {
+		node.terminal = true
+		t.size++
+	}
+	return nil
+}
+
+// Reports whether address falls into any range of the set.
+func (t *IPTrie) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	node := &t.root
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[bitAt(ip, i)]
+	}
+	return false
+}
+
+func (t *IPTrie) ContainsString(ip string) bool {
+	addr := net.ParseIP(ip)
+	return addr != nil && t.Contains(addr)
+}
+
+// Reports whether any range of the set covers or lies within the given one.
+func (t *IPTrie) Overlaps(n *net.IPNet) bool {
+	if t.size == 0 {
+		return false
+	}
+	ip, ones := trieKey(n)
+	node := &t.root
+	for i := 0; i < ones; i++ {
+		if node.terminal {
+			return true
+		}
+		node = node.children[bitAt(ip, i)]
+		if node == nil {
+			return false
+		}
+	}
+	// Nodes exist only on paths to ranges, so any node below holds one
+	return true
+}
+
+func (t *IPTrie) Len() int {
+	return t.size
+}
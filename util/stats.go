@@ -0,0 +1,21 @@
+package util
+
+import "math"
+
+// Probability of k or fewer events when lambda events are expected, Poisson distribution.
+func PoissonCDF(k int64, lambda float64) float64 {
+	if lambda <= 0 {
+		return 1
+	}
+	// Terms are summed in log space, e^-lambda alone underflows for large lambda
+	sum := 0.0
+	logTerm := -lambda
+	logLambda := math.Log(lambda)
+	for i := int64(0); i <= k; i++ {
+		if i > 0 {
+			logTerm += logLambda - math.Log(float64(i))
+		}
+		sum += math.Exp(logTerm)
+	}
+	return math.Min(sum, 1)
+}
@@ -17,3 +17,84 @@ func Test_Util(t *testing.T) {
 	bool := IsValidBase58Address("4xbbVNj1QNLDEJzyjo8jZpJgetT3pjYVkaavDmsD6GQrF2Fn9XSbpFpgPjKGxoraMQDPuGTYuNyYQumAKNsmCqZu")
 	fmt.Print(bool)
 }
+
+func TestIPTrie(t *testing.T) {
+	trie := NewIPTrie()
+	for _, v := range []string{"10.1.2.0/24", "192.168.0.7", "2001:db8::/32"} {
+		if err := trie.Insert(v); err != nil {
+			t.Fatalf("Failed to insert %v: %v", v, err)
+		}
+	}
+	if err := trie.Insert("10.1.2.0/33"); err == nil {
+		t.Error("Invalid range must be rejected")
+	}
+	if trie.Len() != 3 {
+		t.Errorf("Expected 3 ranges, got %v", trie.Len())
+	}
+
+	for ip, expected := range map[string]bool{
+		"10.1.2.0":        true,
+		"10.1.2.255":      true,
+		"10.1.3.0":        false,
+		"192.168.0.7":     true,
+		"192.168.0.8":     false,
+		"2001:db8:1::1":   true,
+		"2001:db9::1":     false,
+		"::ffff:10.1.2.9": true,
+		"garbage":         false,
+	} {
+		if trie.ContainsString(ip) != expected {
+			t.Errorf("Expected %v for %v", expected, ip)
+		}
+	}
+
+	for cidr, expected := range map[string]bool{
+		"10.1.0.0/16":    true,
+		"10.1.2.128/25":  true,
+		"192.168.0.0/24": true,
+		"192.168.1.0/24": false,
+		"2001:db8::/64":  true,
+		"2001:db9::/64":  false,
+	} {
+		n, _ := ParseIPNet(cidr)
+		if trie.Overlaps(n) != expected {
+			t.Errorf("Expected overlap %v for %v", expected, cidr)
+		}
+	}
+	n, _ := ParseIPNet("0.0.0.0/0")
+	if NewIPTrie().Overlaps(n) {
+		t.Error("Empty set must not overlap anything")
+	}
+}
+
+func TestSubnet(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"10.1.2.3":             "10.1.2.0/24",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+		"invalid":              "",
+	} {
+		if subnet := Subnet(ip); subnet != expected {
+			t.Errorf("Expected %v for %v, got %v", expected, ip, subnet)
+		}
+	}
+}
+
+func TestPoissonCDF(t *testing.T) {
+	for _, v := range []struct {
+		k        int64
+		lambda   float64
+		expected float64
+	}{
+		{0, 0, 1},
+		{0, 1, 0.367879},
+		{2, 3, 0.423190},
+		{5, 5, 0.615961},
+		{0, 20, 2.061154e-9},
+		{900, 1000, 0.000698},
+	} {
+		p := PoissonCDF(v.k, v.lambda)
+		if diff := p - v.expected; diff > v.expected*1e-3 || diff < -v.expected*1e-3 {
+			t.Errorf("Expected %v for k=%v lambda=%v, got %v", v.expected, v.k, v.lambda, p)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// +build go1.9
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+
+	"github.com/sero-cash/go-sero/common"
+
+	"github.com/sero-cash/mine-pool/progpow_go"
+)
+
+// Usage: mine-pool verify [-cachedir dir] [-difficulty n] <height> <header hash> <nonce> <mix digest>
+// or mine-pool verify -selftest [-vectors vectors.json] to check the verifier itself.
+func runVerify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	cacheDir := flags.String("cachedir", progpow_go.DefaultConfig.CacheDir, "Directory of verification caches, empty keeps them in memory")
+	difficulty := flags.Int64("difficulty", 0, "Also check the submission against this difficulty")
+	selfTest := flags.Bool("selftest", false, "Check verification across SIP3 fork and known-good vectors")
+	vectorsFile := flags.String("vectors", "", "JSON array of known-good submissions for self-test")
+	flags.Parse(args)
+
+	config := progpow_go.DefaultConfig
+	config.CacheDir = *cacheDir
+	hasher := progpow_go.New(config)
+
+	if *selfTest {
+		var vectors []progpow_go.Vector
+		if len(*vectorsFile) > 0 {
+			file, err := os.Open(*vectorsFile)
+			if err != nil {
+				log.Fatalf("Failed to open vectors: %v", err)
+			}
+			err = json.NewDecoder(file).Decode(&vectors)
+			file.Close()
+			if err != nil {
+				log.Fatalf("Failed to parse vectors: %v", err)
+			}
+		}
+		if err := hasher.SelfTest(vectors); err != nil {
+			log.Fatalf("Self-test failed: %v", err)
+		}
+		log.Printf("Self-test passed, %v known-good vectors checked", len(progpow_go.MainnetVectors)+len(vectors))
+		return
+	}
+
+	if flags.NArg() != 4 {
+		log.Fatal("Usage: verify [-cachedir dir] [-difficulty n] <height> <header hash> <nonce> <mix digest>")
+	}
+	height, err := strconv.ParseUint(flags.Arg(0), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid height %q", flags.Arg(0))
+	}
+	hash := common.HexToHash(flags.Arg(1))
+	nonce, err := progpow_go.ParseNonce(flags.Arg(2))
+	if err != nil {
+		log.Fatalf("Invalid nonce %q", flags.Arg(2))
+	}
+	mix := common.HexToHash(flags.Arg(3))
+
+	digest, result := hasher.Compute(height, hash, nonce)
+	value := new(big.Int).SetBytes(result)
+	valid := common.BytesToHash(digest) == mix
+
+	fmt.Printf("algorithm:  %s (epoch %d)\n", progpow_go.Algorithm(height), progpow_go.Epoch(height))
+	fmt.Printf("mix:        0x%x\n", digest)
+	fmt.Printf("mix match:  %v\n", valid)
+	fmt.Printf("result:     0x%x\n", result)
+	fmt.Printf("difficulty: %v\n", progpow_go.ResultDifficulty(value))
+	if *difficulty > 0 {
+		meets := progpow_go.CheckDifficulty(value, big.NewInt(*difficulty))
+		fmt.Printf("target met: %v (difficulty %v)\n", meets, *difficulty)
+		valid = valid && meets
+	}
+	if !valid {
+		os.Exit(1)
+	}
+}